@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/currantlabs/ble/linux"
+	"github.com/currantlabs/ble/linux/hci/cmd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// currentAdapter mirrors bleDevice for readers that must not take bleMutex
+	currentAdapter atomic.Pointer[linux.Device]
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mi_ble_adapter_up",
+		Help: "Whether the HCI device is open and its socket healthy",
+	}, func() float64 {
+		if AdapterUp() {
+			return 1
+		}
+		return 0
+	})
+	bleAdapterInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mi_ble_adapter_info",
+		Help: "BLE adapter address and HCI version",
+	},
+		[]string{"address", "hci_version", "manufacturer"})
+	bleResetRequestsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mi_ble_reset_requests_total",
+		Help: "BLE device reset requests by trigger",
+	},
+		[]string{"trigger"})
+	bleResetsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mi_ble_resets_total",
+		Help: "BLE device resets by trigger and result",
+	},
+		[]string{"trigger", "result"})
+	bleLastReset = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mi_ble_last_reset_timestamp_seconds",
+		Help: "Time of the last successful BLE device reset",
+	})
+)
+
+// maxResetHistory is the number of BLE resets kept for the status page
+const maxResetHistory = 20
+
+// AdapterInfo describes the BLE adapter in use
+type AdapterInfo struct {
+	Address      string
+	HCIVersion   string
+	Manufacturer string
+}
+
+// ResetEvent is one finished BLE device reset
+type ResetEvent struct {
+	Time    time.Time
+	Trigger string
+	Error   string
+}
+
+var (
+	adapterInfo  AdapterInfo
+	resetHistory []ResetEvent
+	adapterMutex sync.Mutex
+)
+
+// GetAdapterInfo returns the details of the current BLE adapter
+func GetAdapterInfo() AdapterInfo {
+	adapterMutex.Lock()
+	defer adapterMutex.Unlock()
+	return adapterInfo
+}
+
+// ResetHistory returns the most recent BLE resets, newest first
+func ResetHistory() []ResetEvent {
+	adapterMutex.Lock()
+	defer adapterMutex.Unlock()
+	history := make([]ResetEvent, len(resetHistory))
+	for i, e := range resetHistory {
+		history[len(resetHistory)-1-i] = e
+	}
+	return history
+}
+
+// hciVersions maps HCI version numbers to Bluetooth Core specification versions
+var hciVersions = map[uint8]string{
+	0: "1.0b", 1: "1.1", 2: "1.2", 3: "2.0", 4: "2.1", 5: "3.0", 6: "4.0",
+	7: "4.1", 8: "4.2", 9: "5.0", 10: "5.1", 11: "5.2", 12: "5.3", 13: "5.4",
+}
+
+// AdapterUp reports whether the BLE adapter is open and its HCI socket has not failed
+func AdapterUp() bool {
+	dev := currentAdapter.Load()
+	return dev != nil && dev.HCI.Error() == nil
+}
+
+// setAdapter records a newly created or removed BLE device and exports its details
+func setAdapter(dev *linux.Device) {
+	currentAdapter.Store(dev)
+	if dev == nil {
+		return
+	}
+
+	var rp cmd.ReadLocalVersionInformationRP
+	version := "unknown"
+	manufacturer := ""
+	if err := dev.HCI.Send(&cmd.ReadLocalVersionInformation{}, &rp); err != nil {
+		slog.Warn("Unable to read HCI version", "error", err)
+	} else {
+		if v, ok := hciVersions[rp.HCIVersion]; ok {
+			version = v
+		} else {
+			version = fmt.Sprintf("0x%02x", rp.HCIVersion)
+		}
+		manufacturer = fmt.Sprintf("0x%04x", rp.ManufacturerName)
+	}
+
+	address := dev.HCI.Addr().String()
+	slog.Info("BLE adapter ready",
+		"address", address,
+		"hciVersion", version,
+		"manufacturer", manufacturer)
+	bleAdapterInfo.Reset()
+	bleAdapterInfo.WithLabelValues(address, version, manufacturer).Set(1)
+
+	adapterMutex.Lock()
+	adapterInfo = AdapterInfo{Address: address, HCIVersion: version, Manufacturer: manufacturer}
+	adapterMutex.Unlock()
+}
+
+// recordReset counts a finished BLE device reset
+func recordReset(trigger string, err error) {
+	e := ResetEvent{Time: time.Now(), Trigger: trigger}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	adapterMutex.Lock()
+	resetHistory = append(resetHistory, e)
+	if len(resetHistory) > maxResetHistory {
+		resetHistory = resetHistory[len(resetHistory)-maxResetHistory:]
+	}
+	adapterMutex.Unlock()
+
+	if err != nil {
+		bleResetsCounter.WithLabelValues(trigger, "failure").Inc()
+		return
+	}
+	bleResetsCounter.WithLabelValues(trigger, "success").Inc()
+	bleLastReset.SetToCurrentTime()
+}
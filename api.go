@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DeviceStatus is the JSON representation of a device served by the REST API
+type DeviceStatus struct {
+	Name   string            `json:"name"`
+	MAC    string            `json:"mac"`
+	Mode   string            `json:"mode"`
+	Model  string            `json:"model"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Up     bool              `json:"up"`
+
+	// Reading holds the latest value of every measurement, Timestamp the time of the last reading
+	Reading   map[string]float64 `json:"reading"`
+	Timestamp *time.Time         `json:"timestamp"`
+	Battery   *float64           `json:"battery"`
+
+	// Poll is the current poll loop step of connect mode devices
+	Poll string `json:"poll,omitempty"`
+
+	ConsecutiveFailures int  `json:"consecutiveFailures"`
+	Errors              int  `json:"errors"`
+	ResetPending        bool `json:"resetPending"`
+}
+
+// deviceStatus returns the current status of a configured device
+func deviceStatus(d Device) DeviceStatus {
+	s := DeviceStatus{
+		Name:    d.Name,
+		MAC:     strings.ToLower(d.Addr),
+		Mode:    d.Mode,
+		Labels:  d.Labels,
+		Reading: make(map[string]float64),
+
+		ConsecutiveFailures: GetConsecutiveFailures(d.Name),
+		Errors:              GetErrors(d.Name),
+		ResetPending:        IsBLEDeviceResetRequested(),
+	}
+	if d.Model != nil {
+		s.Model = d.Model.Name
+	}
+
+	if state, ok := stateStore.Get(d.Name); ok {
+		s.Up = state.Up
+		s.Poll = state.Poll
+		for measurement, sample := range state.Samples {
+			s.Reading[measurement] = sample.Value
+		}
+		if !state.Updated.IsZero() {
+			s.Timestamp = &state.Updated
+		}
+		if battery, ok := state.Value("battery"); ok {
+			s.Battery = &battery
+		}
+	}
+	return s
+}
+
+// writeJSON encodes v as the response body
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Unable to encode response", "error", err)
+	}
+}
+
+// devicesHandler serves the status of every configured device
+func devicesHandler(w http.ResponseWriter, r *http.Request) {
+	devices := make([]DeviceStatus, 0, len(globalConfig.Devices))
+	for _, d := range globalConfig.Devices {
+		devices = append(devices, deviceStatus(d))
+	}
+	writeJSON(w, devices)
+}
+
+// deviceHandler serves the status of the device named in the path
+func deviceHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	for _, d := range globalConfig.Devices {
+		if d.Name == name {
+			writeJSON(w, deviceStatus(d))
+			return
+		}
+	}
+	http.Error(w, "unknown device", http.StatusNotFound)
+}
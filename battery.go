@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/currantlabs/ble"
+)
+
+// A battery level read from the Battery Service is preferred over the curve for this long
+const reportedBatteryMaxAge = time.Hour
+
+var (
+	// Battery Service and its Battery Level characteristic
+	batteryServiceUUID = ble.UUID16(0x180f)
+	batteryLevelUUID   = ble.UUID16(0x2a19)
+
+	// Built-in discharge curves by upper case name
+	batteryCurves = map[string]*BatteryCurve{
+		// Straight line from 2.1 V to 3.1 V
+		"LINEAR": {Name: "linear", Points: []BatteryPoint{
+			{2.1, 0}, {3.1, 100},
+		}},
+		// Lithium coin cells hold 2.9-3.0 V for most of their life, then drop sharply
+		"CR2032": {Name: "CR2032", Points: []BatteryPoint{
+			{2.0, 0}, {2.4, 5}, {2.6, 10}, {2.7, 20}, {2.8, 40}, {2.85, 55}, {2.9, 75}, {2.95, 90}, {3.0, 100},
+		}},
+		"CR2450": {Name: "CR2450", Points: []BatteryPoint{
+			{2.0, 0}, {2.4, 5}, {2.6, 12}, {2.7, 25}, {2.8, 50}, {2.85, 65}, {2.9, 80}, {2.95, 90}, {3.0, 100},
+		}},
+		// Two alkaline AAA cells in series
+		"AAA": {Name: "AAA", Points: []BatteryPoint{
+			{2.0, 0}, {2.2, 10}, {2.4, 25}, {2.6, 45}, {2.8, 65}, {3.0, 85}, {3.2, 100},
+		}},
+	}
+
+	reportedBattery      = make(map[string]reportedBatteryLevel)
+	reportedBatteryMutex sync.Mutex
+)
+
+// BatteryPoint maps a cell voltage to a charge percentage
+type BatteryPoint struct {
+	Voltage float64
+	Percent float64
+}
+
+// BatteryCurve estimates the charge percentage from the battery voltage
+type BatteryCurve struct {
+	Name   string
+	Points []BatteryPoint
+}
+
+// Percent interpolates the charge percentage for a voltage, clamped to the curve ends
+func (c *BatteryCurve) Percent(v float64) float64 {
+	p := c.Points
+	if v <= p[0].Voltage {
+		return p[0].Percent
+	}
+	for i := 1; i < len(p); i++ {
+		if v <= p[i].Voltage {
+			f := (v - p[i-1].Voltage) / (p[i].Voltage - p[i-1].Voltage)
+			return math.Round((p[i-1].Percent+f*(p[i].Percent-p[i-1].Percent))*100) / 100
+		}
+	}
+	return p[len(p)-1].Percent
+}
+
+// ParseBatteryCurve parses a "voltage:percent,voltage:percent,..." point table.
+// Points may be listed in any order, but the percentage must not drop as the voltage rises.
+func ParseBatteryCurve(name, s string) (*BatteryCurve, error) {
+	c := &BatteryCurve{Name: name}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("battery curve %s: invalid point %q", name, pair)
+		}
+		v, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("battery curve %s: invalid voltage %q", name, parts[0])
+		}
+		p, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || p < 0 || p > 100 {
+			return nil, fmt.Errorf("battery curve %s: invalid percentage %q", name, parts[1])
+		}
+		c.Points = append(c.Points, BatteryPoint{v, p})
+	}
+	if len(c.Points) < 2 {
+		return nil, fmt.Errorf("battery curve %s: at least 2 points required", name)
+	}
+
+	sort.Slice(c.Points, func(i, j int) bool { return c.Points[i].Voltage < c.Points[j].Voltage })
+	for i := 1; i < len(c.Points); i++ {
+		if c.Points[i].Voltage == c.Points[i-1].Voltage {
+			return nil, fmt.Errorf("battery curve %s: duplicate voltage %.3f", name, c.Points[i].Voltage)
+		}
+		if c.Points[i].Percent < c.Points[i-1].Percent {
+			return nil, fmt.Errorf("battery curve %s: percentage drops from %.1f to %.1f as voltage rises to %.3f",
+				name, c.Points[i-1].Percent, c.Points[i].Percent, c.Points[i].Voltage)
+		}
+	}
+	return c, nil
+}
+
+// AddBatteryCurve registers a battery curve, replacing a built-in curve with the same name
+func AddBatteryCurve(c *BatteryCurve) {
+	batteryCurves[strings.ToUpper(c.Name)] = c
+}
+
+// LookupBatteryCurve returns the battery curve with the given name, ignoring case
+func LookupBatteryCurve(name string) (*BatteryCurve, error) {
+	if c, ok := batteryCurves[strings.ToUpper(name)]; ok {
+		return c, nil
+	}
+
+	names := make([]string, 0, len(batteryCurves))
+	for _, c := range batteryCurves {
+		names = append(names, c.Name)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown battery curve %q, available curves: %s", name, strings.Join(names, ", "))
+}
+
+// reportedBatteryLevel is a battery percentage read from the device
+type reportedBatteryLevel struct {
+	Percent float64
+	Read    time.Time
+}
+
+// GetReportedBattery returns the battery percentage recently reported by the device, if any
+func GetReportedBattery(deviceName string) (float64, bool) {
+	reportedBatteryMutex.Lock()
+	defer reportedBatteryMutex.Unlock()
+
+	l, ok := reportedBattery[deviceName]
+	if !ok || time.Since(l.Read) > reportedBatteryMaxAge {
+		return 0, false
+	}
+	return l.Percent, true
+}
+
+// batteryPercent returns the battery percentage of a device, preferring the level it reported itself
+func (d *Device) batteryPercent(v float64) float64 {
+	if p, ok := GetReportedBattery(d.Name); ok {
+		return p
+	}
+	return d.BatteryCurve.Percent(v)
+}
+
+// readBatteryLevel reads the standard Battery Service level if the device has one
+func (d *Device) readBatteryLevel(p *ble.Profile) {
+	c := findCharacteristic(p, batteryServiceUUID, batteryLevelUUID)
+	if c == nil || c.Property&ble.CharRead == 0 {
+		return
+	}
+
+	b, err := d.Client.ReadCharacteristic(c)
+	if err != nil || len(b) < 1 {
+		slog.Warn("Error reading battery level",
+			"device", d.Name,
+			"error", err)
+		return
+	}
+
+	slog.Info("Read battery level", "device", d.Name, "batteryPercent", b[0])
+	setReportedBattery(d.Name, b[0])
+}
+
+// setReportedBattery records a battery percentage reported by the device
+func setReportedBattery(deviceName string, percent byte) {
+	reportedBatteryMutex.Lock()
+	defer reportedBatteryMutex.Unlock()
+	reportedBattery[deviceName] = reportedBatteryLevel{
+		Percent: math.Min(float64(percent), 100),
+		Read:    time.Now(),
+	}
+}
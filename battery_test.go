@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestBatteryCurvePercent(t *testing.T) {
+	// Points are sorted by voltage
+	curve, err := ParseBatteryCurve("test", "3.0:100, 2.0:0, 2.8:40")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		voltage float64
+		want    float64
+	}{
+		{1.5, 0},
+		{2.0, 0},
+		{2.4, 20},
+		{2.8, 40},
+		{2.9, 70},
+		{3.0, 100},
+		{3.3, 100},
+	} {
+		if got := curve.Percent(tt.voltage); got != tt.want {
+			t.Errorf("Percent(%v) = %v, want %v", tt.voltage, got, tt.want)
+		}
+	}
+}
+
+func TestParseBatteryCurveErrors(t *testing.T) {
+	for name, points := range map[string]string{
+		"one point":         "3.0:100",
+		"unsorted percent":  "2.0:0,2.5:60,2.8:40,3.0:100",
+		"duplicate voltage": "2.0:0,2.5:50,2.5:60,3.0:100",
+		"malformed point":   "2.0-0,3.0:100",
+		"invalid voltage":   "low:0,3.0:100",
+		"percent above 100": "2.0:0,3.0:101",
+		"negative percent":  "2.0:-1,3.0:100",
+	} {
+		if _, err := ParseBatteryCurve("test", points); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/currantlabs/ble"
+)
+
+var (
+	// BTHome v2 service data UUID
+	bthomeUUID = ble.UUID16(0xfcd2)
+)
+
+// BTHome device information bits
+const (
+	bthomeEncrypted   = 0x01
+	bthomeVersionMask = 0xe0
+	bthomeVersion2    = 0x40
+)
+
+// bthomeMaxInstances is the number of objects of one measurement kept per frame.
+// Later instances are exported with an index suffix, such as temperature_2.
+const bthomeMaxInstances = 3
+
+// bthomeObject describes a BTHome v2 object ID
+type bthomeObject struct {
+	Measurement string
+	Help        string
+	Size        int
+	Signed      bool
+	Factor      float64
+}
+
+// bthomeCount is the measurement of BTHome count objects, exported as a counter
+const bthomeCount = "count_total"
+
+// bthomeObjects lists the supported BTHome v2 object IDs.
+// Objects without a measurement are decoded only to skip over them, this includes
+// packet ids, timestamps, channels and device details that identify a frame rather than measure anything.
+var bthomeObjects = map[byte]bthomeObject{
+	0x00: {"", "packet id", 1, false, 1},
+	0x01: {"battery", "battery level", 1, false, 1},
+	0x02: {"temperature", "temperature", 2, true, 0.01},
+	0x03: {"humidity", "humidity", 2, false, 0.01},
+	0x04: {"pressure", "pressure in hPa", 3, false, 0.01},
+	0x05: {"illuminance", "illuminance in lux", 3, false, 0.01},
+	0x06: {"mass_kg", "mass in kg", 2, false, 0.01},
+	0x07: {"mass_lb", "mass in lb", 2, false, 0.01},
+	0x08: {"dew_point", "dew point", 2, true, 0.01},
+	0x09: {bthomeCount, "count", 1, false, 1},
+	0x0a: {"energy", "energy in kWh", 3, false, 0.001},
+	0x0b: {"power", "power in W", 3, false, 0.01},
+	0x0c: {"voltage", "voltage", 2, false, 0.001},
+	0x0d: {"pm25", "PM2.5 in ug/m3", 2, false, 1},
+	0x0e: {"pm10", "PM10 in ug/m3", 2, false, 1},
+	0x0f: {"generic_boolean", "generic boolean state", 1, false, 1},
+	0x10: {"power_on", "power state", 1, false, 1},
+	0x11: {"opening", "opening state", 1, false, 1},
+	0x12: {"co2", "CO2 in ppm", 2, false, 1},
+	0x13: {"tvoc", "TVOC in ug/m3", 2, false, 1},
+	0x14: {"moisture", "moisture", 2, false, 0.01},
+	0x15: {"battery_low", "low battery state", 1, false, 1},
+	0x16: {"battery_charging", "battery charging state", 1, false, 1},
+	0x17: {"carbon_monoxide", "carbon monoxide state", 1, false, 1},
+	0x18: {"cold", "cold state", 1, false, 1},
+	0x19: {"connectivity", "connectivity state", 1, false, 1},
+	0x1a: {"door", "door state", 1, false, 1},
+	0x1b: {"garage_door", "garage door state", 1, false, 1},
+	0x1c: {"gas", "gas detected state", 1, false, 1},
+	0x1d: {"heat", "heat state", 1, false, 1},
+	0x1e: {"light", "light state", 1, false, 1},
+	0x1f: {"lock", "lock state", 1, false, 1},
+	0x20: {"moisture_detected", "moisture detected state", 1, false, 1},
+	0x21: {"motion", "motion state", 1, false, 1},
+	0x22: {"moving", "moving state", 1, false, 1},
+	0x23: {"occupancy", "occupancy state", 1, false, 1},
+	0x24: {"plug", "plug state", 1, false, 1},
+	0x25: {"presence", "presence state", 1, false, 1},
+	0x26: {"problem", "problem state", 1, false, 1},
+	0x27: {"running", "running state", 1, false, 1},
+	0x28: {"safety", "safety state", 1, false, 1},
+	0x29: {"smoke", "smoke state", 1, false, 1},
+	0x2a: {"sound", "sound state", 1, false, 1},
+	0x2b: {"tamper", "tamper state", 1, false, 1},
+	0x2c: {"vibration", "vibration state", 1, false, 1},
+	0x2d: {"window", "window state", 1, false, 1},
+	0x2e: {"humidity", "humidity", 1, false, 1},
+	0x2f: {"moisture", "moisture", 1, false, 1},
+	0x3a: {"button_event", "last button event", 1, false, 1},
+	0x3c: {"dimmer_steps", "last dimmer rotation in steps, negative to the left", 2, false, 1},
+	0x3d: {bthomeCount, "count", 2, false, 1},
+	0x3e: {bthomeCount, "count", 4, false, 1},
+	0x3f: {"rotation", "rotation in degrees", 2, true, 0.1},
+	0x40: {"distance_mm", "distance in mm", 2, false, 1},
+	0x41: {"distance_m", "distance in m", 2, false, 0.1},
+	0x42: {"duration", "duration in seconds", 3, false, 0.001},
+	0x43: {"current", "current in A", 2, false, 0.001},
+	0x44: {"speed", "speed in m/s", 2, false, 0.01},
+	0x45: {"temperature", "temperature", 2, true, 0.1},
+	0x46: {"uv_index", "UV index", 1, false, 0.1},
+	0x47: {"volume_l", "volume in L", 2, false, 0.1},
+	0x48: {"volume_ml", "volume in mL", 2, false, 1},
+	0x49: {"volume_flow_rate", "volume flow rate in m3/h", 2, false, 0.001},
+	0x4a: {"voltage", "voltage", 2, false, 0.1},
+	0x4b: {"gas_volume", "gas volume in m3", 3, false, 0.001},
+	0x4c: {"gas_volume", "gas volume in m3", 4, false, 0.001},
+	0x4d: {"energy", "energy in kWh", 4, false, 0.001},
+	0x4e: {"volume_l", "volume in L", 4, false, 0.001},
+	0x4f: {"water", "water in L", 4, false, 0.001},
+	0x50: {"", "device timestamp in seconds", 4, false, 1},
+	0x51: {"acceleration", "acceleration in m/s2", 2, false, 0.001},
+	0x52: {"gyroscope", "gyroscope in degrees/s", 2, false, 0.001},
+	0x55: {"volume_storage", "volume storage in L", 4, false, 0.001},
+	0x56: {"conductivity", "conductivity in uS/cm", 2, false, 1},
+	0x57: {"temperature", "temperature", 1, true, 1},
+	0x58: {"temperature", "temperature", 1, true, 0.35},
+	0x59: {bthomeCount, "count", 1, true, 1},
+	0x5a: {bthomeCount, "count", 2, true, 1},
+	0x5b: {bthomeCount, "count", 4, true, 1},
+	0x5c: {"power", "power in W", 4, true, 0.01},
+	0x5d: {"current", "current in A", 2, true, 0.001},
+	0x5e: {"direction", "direction in degrees", 2, false, 0.01},
+	0x5f: {"precipitation", "precipitation in mm", 2, false, 0.1},
+	0x60: {"", "channel", 1, false, 1},
+	0xf0: {"", "device type id", 2, false, 1},
+	0xf1: {"", "firmware version", 4, false, 1},
+	0xf2: {"", "firmware version", 3, false, 1},
+}
+
+func init() {
+	// Export a gauge for every BTHome measurement not covered by the MI gauges, counts as counters
+	for _, o := range bthomeObjects {
+		if o.Measurement == "" {
+			continue
+		}
+		register := RegisterSensorMetric
+		if o.Measurement == bthomeCount {
+			register = RegisterSensorCounter
+		}
+		register(o.Measurement, "BTHome sensor "+o.Help)
+		for i := 2; i <= bthomeMaxInstances; i++ {
+			register(bthomeInstanceName(o.Measurement, i), fmt.Sprintf("BTHome sensor %s, instance %d", o.Help, i))
+		}
+	}
+}
+
+// BTHome represents a decoded BTHome v2 frame
+type BTHome struct {
+	Encrypted bool
+	Counter   uint32
+	PacketID  int
+	Values    map[string]float64
+}
+
+// UnmarshallBTHome converts BTHome v2 service data into a BTHome.
+// Encrypted frames require the device key and MAC address.
+func UnmarshallBTHome(req []byte, addr string, key []byte) (*BTHome, error) {
+	// 00 01 ...
+	// DI OBJECTS [COUNTER MIC]
+	l := len(req)
+	if l < 1 {
+		return &BTHome{}, errors.New("Expecting at least 1 byte got 0")
+	}
+
+	info := req[0]
+	if info&bthomeVersionMask != bthomeVersion2 {
+		return &BTHome{}, fmt.Errorf("Unsupported BTHome version %d", info>>5)
+	}
+
+	b := &BTHome{
+		Encrypted: info&bthomeEncrypted != 0,
+		PacketID:  -1,
+		Values:    make(map[string]float64),
+	}
+
+	payload := req[1:]
+	if b.Encrypted {
+		if len(key) == 0 {
+			return b, errors.New("Encrypted BTHome frame requires a bindkey")
+		}
+		// Payload is followed by a 4 byte counter and a 4 byte MIC
+		if len(payload) < 9 {
+			return b, fmt.Errorf("Truncated encrypted payload of %d bytes", len(payload))
+		}
+		mac, err := parseMAC(addr)
+		if err != nil {
+			return b, err
+		}
+
+		counter := req[l-8 : l-4]
+		nonce := make([]byte, 0, 13)
+		nonce = append(nonce, mac...)
+		nonce = append(nonce, 0xd2, 0xfc, info)
+		nonce = append(nonce, counter...)
+
+		payload, err = ccmOpen(key, nonce, payload[:len(payload)-8], req[l-4:], nil)
+		if err != nil {
+			return b, err
+		}
+		b.Counter = uint32(counter[0]) | uint32(counter[1])<<8 | uint32(counter[2])<<16 | uint32(counter[3])<<24
+	}
+
+	return b, b.parseObjects(payload)
+}
+
+// bthomeInstanceName returns the measurement name of the n-th object of a measurement in a frame.
+// The index goes before a _total suffix, such as count_2_total.
+func bthomeInstanceName(measurement string, n int) string {
+	if n == 1 {
+		return measurement
+	}
+	if base, ok := strings.CutSuffix(measurement, "_total"); ok {
+		return fmt.Sprintf("%s_%d_total", base, n)
+	}
+	return fmt.Sprintf("%s_%d", measurement, n)
+}
+
+// parseObjects decodes the object ID prefixed values of a BTHome payload
+func (b *BTHome) parseObjects(payload []byte) error {
+	instances := make(map[string]int)
+	for len(payload) > 0 {
+		id := payload[0]
+		payload = payload[1:]
+
+		// Text and raw objects are length prefixed
+		if id == 0x53 || id == 0x54 {
+			if len(payload) < 1 || len(payload) < 1+int(payload[0]) {
+				return fmt.Errorf("Truncated object 0x%02x", id)
+			}
+			payload = payload[1+int(payload[0]):]
+			continue
+		}
+
+		o, ok := bthomeObjects[id]
+		if !ok {
+			// Object sizes are implied by the ID, so nothing after an unknown one can be parsed
+			return fmt.Errorf("Unsupported object 0x%02x", id)
+		}
+		if len(payload) < o.Size {
+			return fmt.Errorf("Truncated object 0x%02x", id)
+		}
+
+		var raw uint32
+		for i := o.Size - 1; i >= 0; i-- {
+			raw = raw<<8 | uint32(payload[i])
+		}
+		payload = payload[o.Size:]
+
+		value := float64(raw)
+		if o.Signed {
+			shift := 32 - 8*o.Size
+			value = float64(int32(raw<<shift) >> shift)
+		}
+
+		switch id {
+		case 0x00:
+			b.PacketID = int(raw)
+		case 0x3c:
+			// Dimmer events carry the direction in the first byte and the steps in the second
+			value = float64(raw >> 8)
+			if raw&0xff == 0x01 {
+				value = -value
+			}
+		}
+		if o.Measurement == "" {
+			continue
+		}
+		// Repeated measurements in one frame come from separate sensors of the device
+		instances[o.Measurement]++
+		if n := instances[o.Measurement]; n <= bthomeMaxInstances {
+			b.Values[bthomeInstanceName(o.Measurement, n)] = math.Round(value*o.Factor*1e6) / 1e6
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnmarshallBTHome(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		addr     string
+		key      string
+		counter  uint32
+		packetID int
+		values   map[string]float64
+	}{
+		{
+			// Encryption example of the BTHome v2 specification
+			name:     "encrypted",
+			data:     "41a47266c95f730011223378237214",
+			addr:     "54:48:E6:8F:80:A5",
+			key:      "231d39c1d7cc1ab1aee224cd096db932",
+			counter:  0x33221100,
+			packetID: -1,
+			values:   map[string]float64{"temperature": 25.06, "humidity": 50.55},
+		},
+		{
+			// Object examples of the BTHome v2 specification
+			name:     "plain",
+			data:     "40000901610c020c02ca0903bf13",
+			packetID: 9,
+			values:   map[string]float64{"battery": 97, "voltage": 3.074, "temperature": 25.06, "humidity": 50.55},
+		},
+		{
+			name:     "repeated objects",
+			data:     "4002ca0902b6084511010289fd",
+			packetID: -1,
+			values:   map[string]float64{"temperature": 25.06, "temperature_2": 22.3, "temperature_3": 27.3},
+		},
+		{
+			name:     "identifying objects are skipped",
+			data:     "4050000000006001f00100f100010204",
+			packetID: -1,
+			values:   map[string]float64{},
+		},
+		{
+			name:     "counts and events",
+			data:     "4009053d01005bffffffff3a043c0103",
+			packetID: -1,
+			values: map[string]float64{
+				"count_total": 5, "count_2_total": 1, "count_3_total": -1,
+				"button_event": 4, "dimmer_steps": -3,
+			},
+		},
+		{
+			name:     "text and raw objects are skipped",
+			data:     "4053034142435401010163",
+			packetID: -1,
+			values:   map[string]float64{"battery": 99},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var key []byte
+			if tt.key != "" {
+				key = unhex(t, tt.key)
+			}
+			b, err := UnmarshallBTHome(unhex(t, tt.data), tt.addr, key)
+			if err != nil {
+				t.Fatalf("UnmarshallBTHome: %v", err)
+			}
+			if b.Counter != tt.counter {
+				t.Errorf("counter = %#x, want %#x", b.Counter, tt.counter)
+			}
+			if b.PacketID != tt.packetID {
+				t.Errorf("packet id = %d, want %d", b.PacketID, tt.packetID)
+			}
+			if !reflect.DeepEqual(b.Values, tt.values) {
+				t.Errorf("values = %v, want %v", b.Values, tt.values)
+			}
+		})
+	}
+}
+
+func TestUnmarshallBTHomeErrors(t *testing.T) {
+	for name, data := range map[string]string{
+		"version 1":      "20",
+		"unknown object": "40ff00",
+		"truncated":      "4002ca",
+	} {
+		if _, err := UnmarshallBTHome(unhex(t, data), "", nil); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+	if _, err := UnmarshallBTHome(unhex(t, "41a47266c95f730011223378237214"), "54:48:E6:8F:80:A5", make([]byte, 16)); err == nil {
+		t.Error("frame decrypted with the wrong key")
+	}
+}
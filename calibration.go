@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+func init() {
+	RegisterSensorMetric("temperature_raw", "MI sensor temperature before calibration")
+	RegisterSensorMetric("humidity_raw", "MI sensor humidity before calibration")
+}
+
+// LinearCalibration corrects a measurement as value*Scale + Offset
+type LinearCalibration struct {
+	Scale  float64
+	Offset float64
+}
+
+// Apply returns the corrected value
+func (c LinearCalibration) Apply(v float64) float64 {
+	return math.Round((v*c.Scale+c.Offset)*100) / 100
+}
+
+// Calibration holds the temperature and humidity corrections of a device
+type Calibration struct {
+	Temperature LinearCalibration
+	Humidity    LinearCalibration
+	// ExportRaw keeps publishing the uncorrected values
+	ExportRaw bool
+}
+
+// identityCalibration leaves measurements unchanged
+var identityCalibration = LinearCalibration{Scale: 1}
+
+// parseTwoPointCalibration derives a LinearCalibration from "raw:reference,raw:reference"
+func parseTwoPointCalibration(s string) (LinearCalibration, error) {
+	points := strings.Split(s, ",")
+	if len(points) != 2 {
+		return identityCalibration, fmt.Errorf("two-point calibration must be raw:reference,raw:reference, got %q", s)
+	}
+
+	var raw, ref [2]float64
+	for i, p := range points {
+		parts := strings.Split(strings.TrimSpace(p), ":")
+		if len(parts) != 2 {
+			return identityCalibration, fmt.Errorf("invalid calibration point %q", p)
+		}
+		var err error
+		if raw[i], err = strconv.ParseFloat(parts[0], 64); err != nil {
+			return identityCalibration, fmt.Errorf("invalid calibration point %q", p)
+		}
+		if ref[i], err = strconv.ParseFloat(parts[1], 64); err != nil {
+			return identityCalibration, fmt.Errorf("invalid calibration point %q", p)
+		}
+	}
+	if raw[0] == raw[1] {
+		return identityCalibration, fmt.Errorf("calibration points must have different raw values, got %q", s)
+	}
+
+	scale := (ref[1] - ref[0]) / (raw[1] - raw[0])
+	return LinearCalibration{
+		Scale:  scale,
+		Offset: ref[0] - raw[0]*scale,
+	}, nil
+}
+
+// parseCalibration reads the calibration of one measurement from a device section.
+// A two-point calibration replaces offset and scale, so they cannot be combined.
+func parseCalibration(ds *ini.Section, measurement string) (LinearCalibration, error) {
+	if k := ds.Key(measurement + "_calibration").String(); k != "" {
+		if ds.HasKey(measurement+"_scale") || ds.HasKey(measurement+"_offset") {
+			return identityCalibration, fmt.Errorf("%s_calibration cannot be combined with %s_scale or %s_offset", measurement, measurement, measurement)
+		}
+		return parseTwoPointCalibration(k)
+	}
+
+	c := identityCalibration
+	var err error
+	if ds.HasKey(measurement + "_scale") {
+		if c.Scale, err = ds.Key(measurement + "_scale").Float64(); err != nil {
+			return c, fmt.Errorf("invalid %s_scale: %w", measurement, err)
+		}
+	}
+	if ds.HasKey(measurement + "_offset") {
+		if c.Offset, err = ds.Key(measurement + "_offset").Float64(); err != nil {
+			return c, fmt.Errorf("invalid %s_offset: %w", measurement, err)
+		}
+	}
+	return c, nil
+}
+
+// calibrate corrects the temperature and humidity in values, exporting the raw values if enabled
+func (d *Device) calibrate(values map[string]float64) {
+	if t, ok := values["temperature"]; ok {
+		if d.Calibration.ExportRaw {
+			values["temperature_raw"] = t
+		}
+		values["temperature"] = d.Calibration.Temperature.Apply(t)
+	}
+	if h, ok := values["humidity"]; ok {
+		if d.Calibration.ExportRaw {
+			values["humidity_raw"] = h
+		}
+		values["humidity"] = math.Max(0, math.Min(100, d.Calibration.Humidity.Apply(h)))
+	}
+}
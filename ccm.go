@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+// ccmOpen decrypts and authenticates an AES-CCM (RFC 3610) ciphertext with a detached tag
+func ccmOpen(key, nonce, ciphertext, tag, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	l := 15 - len(nonce)
+	if l < 2 || l > 8 {
+		return nil, fmt.Errorf("invalid CCM nonce length %d", len(nonce))
+	}
+	m := len(tag)
+	if m < 4 || m > 16 || m%2 != 0 {
+		return nil, fmt.Errorf("invalid CCM tag length %d", m)
+	}
+
+	// Counter blocks: flags | nonce | counter
+	ctr := make([]byte, aes.BlockSize)
+	ctr[0] = byte(l - 1)
+	copy(ctr[1:], nonce)
+
+	s0 := make([]byte, aes.BlockSize)
+	block.Encrypt(s0, ctr)
+
+	plaintext := make([]byte, len(ciphertext))
+	ctr[aes.BlockSize-1] = 1
+	cipher.NewCTR(block, ctr).XORKeyStream(plaintext, ciphertext)
+
+	expected := ccmMAC(block, nonce, plaintext, aad, l, m)
+	for i := range expected {
+		expected[i] ^= s0[i]
+	}
+	if subtle.ConstantTimeCompare(expected, tag) != 1 {
+		return nil, errors.New("CCM authentication failed")
+	}
+	return plaintext, nil
+}
+
+// ccmMAC computes the unencrypted CBC-MAC over the associated data and plaintext
+func ccmMAC(block cipher.Block, nonce, plaintext, aad []byte, l, m int) []byte {
+	b := make([]byte, aes.BlockSize)
+	b[0] = byte(((m - 2) / 2 << 3) | (l - 1))
+	if len(aad) > 0 {
+		b[0] |= 0x40
+	}
+	copy(b[1:], nonce)
+	n := len(plaintext)
+	for i := aes.BlockSize - 1; i > aes.BlockSize-1-l; i-- {
+		b[i] = byte(n)
+		n >>= 8
+	}
+
+	x := make([]byte, aes.BlockSize)
+	block.Encrypt(x, b)
+
+	mac := func(data []byte) {
+		for len(data) > 0 {
+			chunk := min(len(data), aes.BlockSize)
+			for i := 0; i < chunk; i++ {
+				x[i] ^= data[i]
+			}
+			block.Encrypt(x, x)
+			data = data[chunk:]
+		}
+	}
+
+	if len(aad) > 0 {
+		// Short associated data is prefixed with its 16-bit length
+		mac(append([]byte{byte(len(aad) >> 8), byte(len(aad))}, aad...))
+	}
+	mac(plaintext)
+
+	return x[:m]
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// unhex decodes a hex test vector
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("invalid hex %q: %v", s, err)
+	}
+	return b
+}
+
+func TestCCMOpenRFC3610(t *testing.T) {
+	// RFC 3610 packet vector #1
+	key := unhex(t, "c0c1c2c3c4c5c6c7c8c9cacbcccdcecf")
+	nonce := unhex(t, "00000003020100a0a1a2a3a4a5")
+	aad := unhex(t, "0001020304050607")
+	ciphertext := unhex(t, "588c979a61c663d2f066d0c2c0f989806d5f6b61dac384")
+	tag := unhex(t, "17e8d12cfdf926e0")
+	want := unhex(t, "08090a0b0c0d0e0f101112131415161718191a1b1c1d1e")
+
+	got, err := ccmOpen(key, nonce, ciphertext, tag, aad)
+	if err != nil {
+		t.Fatalf("ccmOpen: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("plaintext = %x, want %x", got, want)
+	}
+
+	tag[0] ^= 1
+	if _, err := ccmOpen(key, nonce, ciphertext, tag, aad); err == nil {
+		t.Error("ccmOpen accepted a corrupted tag")
+	}
+}
+
+func TestCCMOpenInvalidParameters(t *testing.T) {
+	key := make([]byte, 16)
+	if _, err := ccmOpen(key, make([]byte, 14), nil, make([]byte, 4), nil); err == nil {
+		t.Error("ccmOpen accepted a 14 byte nonce")
+	}
+	if _, err := ccmOpen(key, make([]byte, 12), nil, make([]byte, 3), nil); err == nil {
+		t.Error("ccmOpen accepted a 3 byte tag")
+	}
+}
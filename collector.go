@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// sensorMetrics holds the help text of the per-device sensor gauges by measurement name
+	sensorMetrics = map[string]string{
+		"temperature":  "MI sensor temperature",
+		"humidity":     "MI sensor humidity",
+		"voltage":      "MI sensor battery voltage",
+		"battery":      "MI sensor battery level",
+		"illuminance":  "MI sensor illuminance in lux",
+		"moisture":     "MI sensor soil moisture",
+		"conductivity": "MI sensor soil conductivity",
+		"formaldehyde": "MI sensor formaldehyde concentration in mg/m3",
+	}
+	// sensorCounters lists the sensor measurements exported as counters instead of gauges
+	sensorCounters = make(map[string]bool)
+)
+
+// RegisterSensorMetric adds a measurement to the exported sensor gauges
+func RegisterSensorMetric(measurement, help string) {
+	if _, ok := sensorMetrics[measurement]; !ok {
+		sensorMetrics[measurement] = help
+	}
+}
+
+// RegisterSensorCounter adds a measurement that only increases, apart from device resets,
+// to the exported sensor metrics as a counter
+func RegisterSensorCounter(measurement, help string) {
+	RegisterSensorMetric(measurement, help)
+	sensorCounters[measurement] = true
+}
+
+// SensorCollector exports a consistent snapshot of the StateStore on each scrape
+type SensorCollector struct {
+	store      *StateStore
+	timestamps bool
+
+	descs      map[string]*prometheus.Desc
+	lastUpdate *prometheus.Desc
+	up         *prometheus.Desc
+}
+
+// NewSensorCollector returns a SensorCollector for the store.
+// With timestamps set, samples carry the time of the reading they come from.
+func NewSensorCollector(store *StateStore, timestamps bool) *SensorCollector {
+	c := &SensorCollector{
+		store:      store,
+		timestamps: timestamps,
+		descs:      make(map[string]*prometheus.Desc),
+		lastUpdate: prometheus.NewDesc("mi_last_update_timestamp_seconds",
+			"Time of the last MI sensor reading", []string{"location"}, nil),
+		up: prometheus.NewDesc("mi_up",
+			"Whether the MI sensor reported within the maximum age", []string{"location"}, nil),
+	}
+	for measurement, help := range sensorMetrics {
+		c.descs[measurement] = prometheus.NewDesc("mi_"+measurement, help, []string{"location"}, nil)
+	}
+	return c
+}
+
+// Describe implements prometheus.Collector
+func (c *SensorCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+	ch <- c.lastUpdate
+	ch <- c.up
+}
+
+// Collect implements prometheus.Collector
+func (c *SensorCollector) Collect(ch chan<- prometheus.Metric) {
+	states := c.store.Snapshot()
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+
+	for _, s := range states {
+		for measurement, sample := range s.Samples {
+			desc, ok := c.descs[measurement]
+			if !ok {
+				continue
+			}
+			valueType := prometheus.GaugeValue
+			if sensorCounters[measurement] {
+				valueType = prometheus.CounterValue
+			}
+			m := prometheus.MustNewConstMetric(desc, valueType, sample.Value, s.Name)
+			if c.timestamps {
+				m = prometheus.NewMetricWithTimestamp(sample.Time, m)
+			}
+			ch <- m
+		}
+
+		if !s.Updated.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.lastUpdate, prometheus.GaugeValue, float64(s.Updated.Unix()), s.Name)
+		}
+		upValue := 0.0
+		if s.Up {
+			upValue = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, upValue, s.Name)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestSensorCollectorCounters(t *testing.T) {
+	store := NewStateStore()
+	store.Update("garage", map[string]float64{"count_total": 42, "temperature": 12.5}, time.Now())
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(NewSensorCollector(store, false))
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := make(map[string]dto.MetricType)
+	for _, mf := range families {
+		types[mf.GetName()] = mf.GetType()
+	}
+	if got := types["mi_count_total"]; got != dto.MetricType_COUNTER {
+		t.Errorf("mi_count_total type = %v, want COUNTER", got)
+	}
+	if got := types["mi_temperature"]; got != dto.MetricType_GAUGE {
+		t.Errorf("mi_temperature type = %v, want GAUGE", got)
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/hex"
+	"fmt"
 	"log/slog"
+	"strings"
 
 	"github.com/currantlabs/ble/linux"
 	"gopkg.in/ini.v1"
@@ -11,6 +14,17 @@ import (
 type Config struct {
 	Devices []Device
 	Host    *linux.Device
+	// Derived lists the enabled derived metrics by name
+	Derived map[string]bool
+	// MQTT enables the MQTT output when set
+	MQTT *MQTTConfig
+	// InfluxDB enables the InfluxDB output when set
+	InfluxDB *InfluxConfig
+}
+
+// deviceSection returns the name of the optional per-device config section
+func deviceSection(name string) string {
+	return "Device." + name
 }
 
 // NewConfig returns a new Config
@@ -25,22 +39,221 @@ func NewConfig(file string) (*Config, error) {
 	if err != nil {
 		return &Config{}, err
 	}
+
+	// Custom battery curves are added next to the built-in ones. Names are matched
+	// ignoring case, so two curves differing only in case would be ambiguous.
+	if bc, err := cfg.GetSection("BatteryCurves"); err == nil {
+		custom := make(map[string]string)
+		for _, key := range bc.Keys() {
+			if other, ok := custom[strings.ToUpper(key.Name())]; ok {
+				return &Config{}, fmt.Errorf("battery curves %s and %s differ only in case", other, key.Name())
+			}
+			custom[strings.ToUpper(key.Name())] = key.Name()
+			curve, err := ParseBatteryCurve(key.Name(), key.String())
+			if err != nil {
+				return &Config{}, err
+			}
+			slog.Info("Found battery curve in config",
+				"curve", curve.Name,
+				"points", len(curve.Points))
+			AddBatteryCurve(curve)
+		}
+	}
+
+	// Battery curves per model replace the model default for every device of that model
+	modelCurves := make(map[string]string)
+	if mc, err := cfg.GetSection("ModelBatteryCurves"); err == nil {
+		for _, key := range mc.Keys() {
+			model, err := LookupModel(key.Name())
+			if err != nil {
+				return &Config{}, err
+			}
+			curve, err := LookupBatteryCurve(key.String())
+			if err != nil {
+				return &Config{}, fmt.Errorf("model %s: %w", model.Name, err)
+			}
+			slog.Info("Found model battery curve in config",
+				"model", model.Name,
+				"batteryCurve", curve.Name)
+			modelCurves[model.Name] = curve.Name
+		}
+	}
 	names := sec.KeyStrings()
 
+	// Labels in the Labels section apply to every device
+	defaultLabels := make(map[string]string)
+	if ls, err := cfg.GetSection("Labels"); err == nil {
+		for _, key := range ls.Keys() {
+			if !validLabelName(key.Name()) {
+				return &Config{}, fmt.Errorf("invalid label name %q", key.Name())
+			}
+			defaultLabels[key.Name()] = key.String()
+		}
+	}
+
+	// Derived metrics are disabled unless switched on
+	derived := make(map[string]bool)
+	if ds, err := cfg.GetSection("Derived"); err == nil {
+		for _, key := range []string{DerivedDewPoint, DerivedAbsoluteHumidity, DerivedHeatIndex, DerivedVPD} {
+			if ds.Key(key).MustBool(false) {
+				slog.Info("Enabled derived metric", "metric", key)
+				derived[key] = true
+			}
+		}
+	}
+
+	var mqttConfig *MQTTConfig
+	if ms, err := cfg.GetSection("MQTT"); err == nil {
+		if mqttConfig, err = parseMQTTConfig(ms); err != nil {
+			return &Config{}, err
+		}
+		slog.Info("Found MQTT output in config", "broker", mqttConfig.Broker)
+	}
+
+	var influxConfig *InfluxConfig
+	if is, err := cfg.GetSection("InfluxDB"); err == nil {
+		if influxConfig, err = parseInfluxConfig(is); err != nil {
+			return &Config{}, err
+		}
+		slog.Info("Found InfluxDB output in config", "url", influxConfig.URL)
+	}
+
 	devices := []Device{}
 	for i, name := range names {
 		addr := sec.Key(name).String()
+
+		mode := ModeConnect
+		modelName := DefaultModel
+		history := false
+		curveName := ""
+		calibration := Calibration{
+			Temperature: identityCalibration,
+			Humidity:    identityCalibration,
+		}
+		firmware := FirmwareStock
+		settings := make(map[string]string)
+		labels := make(map[string]string)
+		for k, v := range defaultLabels {
+			labels[k] = v
+		}
+		var bindkey []byte
+		ds, dsErr := cfg.GetSection(deviceSection(name))
+		if dsErr == nil {
+			mode = ds.Key("mode").MustString(ModeConnect)
+			modelName = ds.Key("model").MustString(DefaultModel)
+			history = ds.Key("history").MustBool(false)
+			curveName = ds.Key("battery_curve").String()
+			if calibration.Temperature, err = parseCalibration(ds, "temperature"); err != nil {
+				return &Config{}, fmt.Errorf("device %s: %w", name, err)
+			}
+			if calibration.Humidity, err = parseCalibration(ds, "humidity"); err != nil {
+				return &Config{}, fmt.Errorf("device %s: %w", name, err)
+			}
+			calibration.ExportRaw = ds.Key("export_raw").MustBool(false)
+			firmware = ds.Key("firmware").MustString(FirmwareStock)
+			if firmware != FirmwareStock && firmware != FirmwarePvvx {
+				return &Config{}, fmt.Errorf("device %s: firmware must be %s or %s, got %q", name, FirmwareStock, FirmwarePvvx, firmware)
+			}
+			deviceLabels, err := parseLabels(ds)
+			if err != nil {
+				return &Config{}, fmt.Errorf("device %s: %w", name, err)
+			}
+			for k, v := range deviceLabels {
+				labels[k] = v
+			}
+			if k := ds.Key("bindkey").String(); k != "" {
+				bindkey, err = hex.DecodeString(k)
+				if err != nil || len(bindkey) != 16 {
+					return &Config{}, fmt.Errorf("device %s: bindkey must be 32 hex characters", name)
+				}
+			}
+		}
+		switch mode {
+		case ModeConnect, ModeScan:
+		default:
+			return &Config{}, fmt.Errorf("device %s: unsupported mode %q", name, mode)
+		}
+		// Only advertisements are encrypted, GATT reads never use the bindkey
+		if bindkey != nil && mode != ModeScan {
+			return &Config{}, fmt.Errorf("device %s: bindkey requires mode = %s", name, ModeScan)
+		}
+
+		model, err := LookupModel(modelName)
+		if err != nil {
+			return &Config{}, fmt.Errorf("device %s: %w", name, err)
+		}
+
+		if curveName == "" {
+			curveName = model.BatteryCurve
+			if c, ok := modelCurves[model.Name]; ok {
+				curveName = c
+			}
+		}
+		curve, err := LookupBatteryCurve(curveName)
+		if err != nil {
+			return &Config{}, fmt.Errorf("device %s: %w", name, err)
+		}
+
+		if dsErr == nil {
+			supported := settingsFor(model, firmware)
+			for _, key := range []string{SettingClock, SettingDisplayUnit, SettingComfort, SettingAdvertisingInterval, SettingConnectionLatency} {
+				if !ds.HasKey(key) {
+					continue
+				}
+				s, ok := supported[key]
+				if !ok {
+					return &Config{}, fmt.Errorf("device %s: setting %s not supported by %s %s firmware", name, key, model.Name, firmware)
+				}
+				if key == SettingClock {
+					enabled, err := ds.Key(key).Bool()
+					if err != nil {
+						return &Config{}, fmt.Errorf("device %s: %s must be true or false", name, key)
+					}
+					if !enabled {
+						continue
+					}
+				}
+				value := ds.Key(key).String()
+				if s.Validate != nil {
+					if err := s.Validate(value); err != nil {
+						return &Config{}, fmt.Errorf("device %s: %s: %w", name, key, err)
+					}
+				}
+				settings[key] = value
+			}
+		}
+
 		slog.Info("Found device in config",
 			"index", i,
 			"device", name,
-			"address", addr)
+			"address", addr,
+			"mode", mode,
+			"model", model.Name,
+			"batteryCurve", curve.Name,
+			"temperatureCalibration", calibration.Temperature,
+			"humidityCalibration", calibration.Humidity,
+			"labels", labels)
 		devices = append(devices, Device{
-			Name: name,
-			Addr: addr,
+			Name:    name,
+			Addr:    addr,
+			Mode:    mode,
+			Model:   model,
+			BindKey: bindkey,
+			History: history,
+
+			BatteryCurve: curve,
+			Calibration:  calibration,
+
+			Firmware: firmware,
+			Settings: settings,
+			Labels:   labels,
 		})
 	}
 
 	return &Config{
-		Devices: devices,
+		Devices:  devices,
+		Derived:  derived,
+		MQTT:     mqttConfig,
+		InfluxDB: influxConfig,
 	}, nil
 }
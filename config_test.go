@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// loadConfig parses an ini snippet through NewConfig
+func loadConfig(t *testing.T, ini string) (*Config, error) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.ini")
+	if err := os.WriteFile(file, []byte(ini), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return NewConfig(file)
+}
+
+func TestNewConfigBindKey(t *testing.T) {
+	const key = "bindkey = 00112233445566778899aabbccddeeff\n"
+
+	if _, err := loadConfig(t, "[Devices]\nd = A4:C1:38:00:00:01\n[Device.d]\nmode = scan\n"+key); err != nil {
+		t.Errorf("bindkey on a scan mode device rejected: %v", err)
+	}
+	_, err := loadConfig(t, "[Devices]\nd = A4:C1:38:00:00:01\n[Device.d]\n"+key)
+	if err == nil || !strings.Contains(err.Error(), "bindkey") {
+		t.Errorf("bindkey on a connect mode device accepted, err = %v", err)
+	}
+}
+
+func TestNewConfigSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		section string
+		valid   bool
+	}{
+		{"stock display unit", "display_unit = F", true},
+		{"bad display unit", "display_unit = K", false},
+		{"unknown firmware", "firmware = atc", false},
+		{"pvvx comfort", "firmware = pvvx\ncomfort = 20,26,30,60", true},
+		{"bad comfort", "firmware = pvvx\ncomfort = 20,26,30", false},
+		{"interval out of range", "firmware = pvvx\nadvertising_interval = 100000", false},
+		{"bad clock sync", "clock_sync = maybe", false},
+		{"comfort on stock firmware", "comfort = 20,26,30,60", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(t, "[Devices]\nd = A4:C1:38:00:00:01\n[Device.d]\n"+tt.section+"\n")
+			if tt.valid && err != nil {
+				t.Errorf("rejected: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("accepted")
+			}
+		})
+	}
+}
+
+func TestNewConfigBatteryCurves(t *testing.T) {
+	const curves = "[BatteryCurves]\ntestlipo = 3.3:0,4.2:100\n"
+
+	if _, err := loadConfig(t, "[Devices]\nd = A4:C1:38:00:00:01\n[BatteryCurves]\ndup = 2:0,3:100\nDUP = 2:0,3.2:100\n"); err == nil {
+		t.Error("curves differing only in case accepted")
+	}
+	if _, err := loadConfig(t, "[Devices]\nd = A4:C1:38:00:00:01\n[ModelBatteryCurves]\nLYWSD03MMC = missing\n"); err == nil {
+		t.Error("unknown model battery curve accepted")
+	}
+
+	config, err := loadConfig(t, "[Devices]\nd = A4:C1:38:00:00:01\ne = A4:C1:38:00:00:02\n"+
+		"[Device.e]\nbattery_curve = aaa\n"+curves+"[ModelBatteryCurves]\nlywsd03mmc = TestLipo\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Devices[0].BatteryCurve.Name; got != "testlipo" {
+		t.Errorf("model curve = %s, want testlipo", got)
+	}
+	if got := config.Devices[1].BatteryCurve.Name; got != "AAA" {
+		t.Errorf("device curve = %s, want AAA", got)
+	}
+}
+
+func TestNewConfigCalibration(t *testing.T) {
+	const device = "[Devices]\nd = A4:C1:38:00:00:01\n[Device.d]\n"
+
+	for name, section := range map[string]string{
+		"equal raw points":     "humidity_calibration = 33:35,33:40\n",
+		"malformed point":      "humidity_calibration = 33-35,75:74\n",
+		"one point":            "humidity_calibration = 33:35\n",
+		"non-numeric point":    "temperature_calibration = a:1,2:3\n",
+		"two-point and offset": "humidity_calibration = 33:35,75:74\nhumidity_offset = 1\n",
+		"two-point and scale":  "temperature_calibration = 0:0.5,30:30.2\ntemperature_scale = 1.1\n",
+		"invalid offset":       "temperature_offset = warm\n",
+	} {
+		if _, err := loadConfig(t, device+section); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	config, err := loadConfig(t, device+"temperature_offset = -0.3\ntemperature_scale = 1.1\n"+
+		"humidity_calibration = 30:35,70:75\nexport_raw = true\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := config.Devices[0]
+	values := map[string]float64{"temperature": 20, "humidity": 50}
+	d.calibrate(values)
+	want := map[string]float64{
+		"temperature": 21.7, "temperature_raw": 20,
+		"humidity": 55, "humidity_raw": 50,
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("calibrated values = %v, want %v", values, want)
+	}
+
+	// Corrected humidity stays within 0-100 %
+	values = map[string]float64{"humidity": 98}
+	d.calibrate(values)
+	if values["humidity"] != 100 {
+		t.Errorf("humidity = %v, want 100", values["humidity"])
+	}
+}
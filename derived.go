@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"sync"
+)
+
+// Derived metric names used as keys in the Derived config section
+const (
+	DerivedDewPoint         = "dew_point"
+	DerivedAbsoluteHumidity = "absolute_humidity"
+	DerivedHeatIndex        = "heat_index"
+	DerivedVPD              = "vpd"
+)
+
+var (
+	// Devices reporting their own dew point, which is never replaced by the derived one
+	reportedDewPoint      = make(map[string]bool)
+	reportedDewPointMutex sync.Mutex
+)
+
+func init() {
+	RegisterSensorMetric("dew_point", "MI sensor dew point")
+	RegisterSensorMetric("absolute_humidity", "MI sensor absolute humidity in g/m3")
+	RegisterSensorMetric("heat_index", "MI sensor heat index")
+	RegisterSensorMetric("vapour_pressure_deficit", "MI sensor vapour pressure deficit in kPa")
+}
+
+// saturationVapourPressure returns the saturation vapour pressure in hPa (Magnus formula)
+func saturationVapourPressure(t float64) float64 {
+	return 6.1094 * math.Exp(17.625*t/(t+243.04))
+}
+
+// DewPoint returns the dew point for a temperature and relative humidity
+func DewPoint(t, rh float64) float64 {
+	g := math.Log(rh/100) + 17.625*t/(t+243.04)
+	return 243.04 * g / (17.625 - g)
+}
+
+// AbsoluteHumidity returns the water vapour density in g/m3
+func AbsoluteHumidity(t, rh float64) float64 {
+	e := rh / 100 * saturationVapourPressure(t)
+	return 216.7 * e / (t + 273.15)
+}
+
+// HeatIndex returns the NOAA heat index in degrees Celsius
+func HeatIndex(t, rh float64) float64 {
+	f := t*9/5 + 32
+
+	// Steadman's simple formula is used below 80F
+	hi := 0.5 * (f + 61 + (f-68)*1.2 + rh*0.094)
+	if (hi+f)/2 >= 80 {
+		// Rothfusz regression with its low and high humidity adjustments
+		hi = -42.379 + 2.04901523*f + 10.14333127*rh - 0.22475541*f*rh -
+			0.00683783*f*f - 0.05481717*rh*rh + 0.00122874*f*f*rh +
+			0.00085282*f*rh*rh - 0.00000199*f*f*rh*rh
+		if rh < 13 && f >= 80 && f <= 112 {
+			hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(f-95))/17)
+		} else if rh > 85 && f >= 80 && f <= 87 {
+			hi += (rh - 85) / 10 * (87 - f) / 5
+		}
+	}
+	return (hi - 32) * 5 / 9
+}
+
+// VapourPressureDeficit returns the vapour pressure deficit in kPa
+func VapourPressureDeficit(t, rh float64) float64 {
+	return saturationVapourPressure(t) * (1 - rh/100) / 10
+}
+
+// deriveClimate adds the enabled derived measurements to values.
+// Either measurement may be missing, in which case the last known value is used.
+func deriveClimate(name string, values map[string]float64) {
+	if globalConfig == nil || len(globalConfig.Derived) == 0 {
+		return
+	}
+
+	// Advertisements may carry temperature and humidity in separate frames
+	t, hasTemperature := values["temperature"]
+	rh, hasHumidity := values["humidity"]
+	if state, ok := stateStore.Get(name); ok {
+		if !hasTemperature {
+			t, hasTemperature = state.Value("temperature")
+		}
+		if !hasHumidity {
+			rh, hasHumidity = state.Value("humidity")
+		}
+	}
+
+	// A dew point from the sensor may arrive in a different frame than temperature and humidity
+	reportedDewPointMutex.Lock()
+	if _, ok := values["dew_point"]; ok {
+		reportedDewPoint[name] = true
+	}
+	reportsDewPoint := reportedDewPoint[name]
+	reportedDewPointMutex.Unlock()
+
+	// Dew point is undefined for zero humidity
+	if !hasTemperature || !hasHumidity || rh <= 0 {
+		return
+	}
+	rh = math.Min(rh, 100)
+
+	round := func(v float64) float64 { return math.Round(v*100) / 100 }
+	if globalConfig.Derived[DerivedDewPoint] && !reportsDewPoint {
+		values["dew_point"] = round(DewPoint(t, rh))
+	}
+	if globalConfig.Derived[DerivedAbsoluteHumidity] {
+		values["absolute_humidity"] = round(AbsoluteHumidity(t, rh))
+	}
+	if globalConfig.Derived[DerivedHeatIndex] {
+		values["heat_index"] = round(HeatIndex(t, rh))
+	}
+	if globalConfig.Derived[DerivedVPD] {
+		values["vapour_pressure_deficit"] = round(VapourPressureDeficit(t, rh))
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestDeriveClimateReportedDewPoint(t *testing.T) {
+	saved := globalConfig
+	globalConfig = &Config{Derived: map[string]bool{DerivedDewPoint: true}}
+	t.Cleanup(func() { globalConfig = saved })
+
+	values := map[string]float64{"temperature": 20, "humidity": 50}
+	deriveClimate("derived-plain", values)
+	if got := values["dew_point"]; got != 9.26 {
+		t.Errorf("derived dew point = %v, want 9.26", got)
+	}
+
+	// A BTHome sensor reporting dew point, then temperature and humidity in another frame
+	values = map[string]float64{"temperature": 20, "humidity": 50, "dew_point": 8.5}
+	deriveClimate("derived-reported", values)
+	if got := values["dew_point"]; got != 8.5 {
+		t.Errorf("reported dew point replaced by %v", got)
+	}
+	values = map[string]float64{"temperature": 21, "humidity": 50}
+	deriveClimate("derived-reported", values)
+	if _, ok := values["dew_point"]; ok {
+		t.Error("dew point derived for a device reporting its own")
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
 	"sync"
 	"sync/atomic"
@@ -12,22 +14,57 @@ import (
 )
 
 var (
-	characteristix = map[uint8]ble.UUID{
-		36: ble.MustParse("ebe0ccc1-7a0a-4b0c-8a1a-6ff2997da3a6"),
-		38: ble.MustParse("00002902-0000-1000-8000-00805f9b34fb"),
-	}
 	// Use atomic for thread safety
 	deviceResetNeeded int32 = 0
 
+	// Name of whatever requested the pending reset first, and when
+	resetTrigger      string
+	resetRequestedAt  time.Time
+	resetTriggerMutex sync.Mutex
+
 	// Track errors per device
 	errorsPerDevice = make(map[string]int)
 	errorsMutex     sync.Mutex
+
+	// Consecutive failed polls per device, kept by RegisterHandler
+	failuresPerDevice = make(map[string]int)
+)
+
+// Poll loop steps of connect mode devices
+const (
+	PollWaiting    = "waiting for adapter"
+	PollConnecting = "connecting"
+	PollReading    = "reading"
+	PollIdle       = "idle"
 )
 
-// RequestBLEDeviceReset marks the BLE device for reset
-func RequestBLEDeviceReset() {
-	slog.Warn("Explicitly requesting BLE device reset")
+// RequestBLEDeviceReset marks the BLE device for reset on behalf of trigger
+func RequestBLEDeviceReset(trigger string) {
+	slog.Warn("Explicitly requesting BLE device reset", "trigger", trigger)
+	bleResetRequestsCounter.WithLabelValues(trigger).Inc()
+	streamHub.Publish(Event{Type: EventResetRequested, Detail: trigger})
+
+	resetTriggerMutex.Lock()
+	if !IsBLEDeviceResetRequested() {
+		resetTrigger = trigger
+		resetRequestedAt = time.Now()
+	}
 	atomic.StoreInt32(&deviceResetNeeded, 1)
+	resetTriggerMutex.Unlock()
+}
+
+// BLEDeviceResetTrigger returns what requested the pending reset
+func BLEDeviceResetTrigger() string {
+	resetTriggerMutex.Lock()
+	defer resetTriggerMutex.Unlock()
+	return resetTrigger
+}
+
+// BLEDeviceResetRequestedAt returns when the pending reset was requested
+func BLEDeviceResetRequestedAt() (time.Time, bool) {
+	resetTriggerMutex.Lock()
+	defer resetTriggerMutex.Unlock()
+	return resetRequestedAt, IsBLEDeviceResetRequested()
 }
 
 // IsBLEDeviceResetRequested checks if a reset has been requested
@@ -37,7 +74,11 @@ func IsBLEDeviceResetRequested() bool {
 
 // ClearBLEDeviceResetRequest clears the reset request
 func ClearBLEDeviceResetRequest() {
+	resetTriggerMutex.Lock()
+	defer resetTriggerMutex.Unlock()
 	atomic.StoreInt32(&deviceResetNeeded, 0)
+	resetTrigger = ""
+	resetRequestedAt = time.Time{}
 }
 
 // IncrementErrors increments the error counter for a device
@@ -53,12 +94,53 @@ func IncrementErrors(deviceName string) int {
 		slog.Warn("Device has accumulated too many errors, requesting reset",
 			"device", deviceName,
 			"errorCount", current)
-		RequestBLEDeviceReset()
+		RequestBLEDeviceReset(deviceName)
 	}
 
 	return current
 }
 
+// Failure stages recorded in the stage error counter
+const (
+	StageConnect     = "connect"
+	StageDiscover    = "discover"
+	StageWriteCCCD   = "write_cccd"
+	StageSubscribe   = "subscribe"
+	StageUnsubscribe = "unsubscribe"
+	StageDecode      = "decode"
+	StageTimeout     = "timeout"
+	StageNoData      = "no_data"
+)
+
+// errorStages lists every failure stage so each series exists from startup
+var errorStages = []string{StageConnect, StageDiscover, StageWriteCCCD, StageSubscribe, StageUnsubscribe, StageDecode, StageTimeout, StageNoData}
+
+// recordError counts a device failure in the given stage
+func recordError(deviceName, stage string) {
+	deviceStageErrorsCounter.WithLabelValues(deviceName, stage).Inc()
+}
+
+// GetErrors returns the current error count of a device
+func GetErrors(deviceName string) int {
+	errorsMutex.Lock()
+	defer errorsMutex.Unlock()
+	return errorsPerDevice[deviceName]
+}
+
+// SetConsecutiveFailures records the consecutive failed polls of a device
+func SetConsecutiveFailures(deviceName string, failures int) {
+	errorsMutex.Lock()
+	defer errorsMutex.Unlock()
+	failuresPerDevice[deviceName] = failures
+}
+
+// GetConsecutiveFailures returns the consecutive failed polls of a device
+func GetConsecutiveFailures(deviceName string) int {
+	errorsMutex.Lock()
+	defer errorsMutex.Unlock()
+	return failuresPerDevice[deviceName]
+}
+
 // ResetErrors resets the error counter for a device
 func ResetErrors(deviceName string) {
 	errorsMutex.Lock()
@@ -67,10 +149,33 @@ func ResetErrors(deviceName string) {
 	errorsPerDevice[deviceName] = 0
 }
 
+// Device polling modes
+const (
+	// ModeConnect reads the sensor over a GATT connection
+	ModeConnect = "connect"
+	// ModeScan listens for advertisements without connecting
+	ModeScan = "scan"
+)
+
 // Device represents a BLE Device
 type Device struct {
-	Name   string
-	Addr   string
+	Name    string
+	Addr    string
+	Mode    string
+	Model   *Model
+	BindKey []byte
+	History bool
+	// BatteryCurve estimates the battery percentage from the voltage
+	BatteryCurve *BatteryCurve
+	Calibration  Calibration
+	// Firmware selects the settings interface, Settings holds the configured values by key
+	Firmware string
+	Settings map[string]string
+	// Labels are attached to every series of the device
+	Labels map[string]string
+	// Link holds the link quality of the current connection or advertisement,
+	// published along with the next reading
+	Link   map[string]float64
 	Client ble.Client
 }
 
@@ -117,14 +222,23 @@ func (d *Device) connectToDevice() bool {
 	slog.Info("Connecting to device", "device", d.Name)
 
 	// Connect to device
-	if err := d.Connect(bleDevice); err != nil {
+	start := time.Now()
+	err := d.Connect(bleDevice)
+	observeSince(connectDuration, d.Name, start)
+	if err != nil {
 		slog.Error("Failed to connect to device",
 			"device", d.Name,
 			"error", err)
 		deviceErrorsCounter.WithLabelValues(d.Name).Inc()
+		if errors.Is(err, context.DeadlineExceeded) {
+			recordError(d.Name, StageTimeout)
+		} else {
+			recordError(d.Name, StageConnect)
+		}
 		return false
 	}
 
+	streamHub.Publish(Event{Type: EventConnected, Device: d.Name})
 	return true
 }
 
@@ -158,13 +272,30 @@ func (d *Device) handleDeviceOperation() (bool, error) {
 		}
 	}()
 
+	// Record link quality while connected
+	d.readLinkQuality()
+
+	// Settings and readings look up their characteristics in the discovered profile
+	profile, _ := d.discoverDeviceProfile(3)
+	if profile == nil {
+		return false, nil
+	}
+
+	// Bring device settings in line with the config before anything can fail
+	d.applySettings()
+
 	// Write to handle to trigger notification
 	slog.Info("Publishing", "device", d.Name)
-	d.pub(characteristix[38], []byte{0x01, 0x00})
+	d.pub(d.Model.Enable, d.Model.EnableValue)
 
 	// Subscribe to readings
 	slog.Info("Subscribing", "device", d.Name)
-	dataSuccess := d.readSensorData(characteristix[36])
+	dataSuccess := d.readSensorData(profile, d.Model.Service, d.Model.Characteristic)
+
+	// Backfill on-device history while still connected
+	if dataSuccess && d.History {
+		d.readHistory()
+	}
 
 	return dataSuccess, disconnectErr
 }
@@ -176,7 +307,7 @@ func (d *Device) checkForResetNeeds(consecutiveFailures int, criticalError bool)
 
 	if consecutiveFailures >= 3 || criticalError {
 		slog.Warn("Requesting BLE device reset due to persistent issues", "device", d.Name)
-		RequestBLEDeviceReset()
+		RequestBLEDeviceReset(d.Name)
 		needsReset = true
 	}
 
@@ -187,23 +318,31 @@ func (d *Device) checkForResetNeeds(consecutiveFailures int, criticalError bool)
 func RegisterHandler(d Device) {
 	consecutiveFailures := 0
 	maxConsecutiveFailures := 5
+	// failureStreak is the real number of failed polls in a row, consecutiveFailures is throttled below
+	failureStreak := 0
 	waitTimeBetweenAttempts := time.Duration(*measurementInterval) * time.Second
 
 	for {
 		// Use the shared BLE device with mutex lock for synchronization
 		slog.Info("Waiting for BLE device access", "device", d.Name)
+		stateStore.SetPoll(d.Name, PollWaiting)
+		waitStart := time.Now()
 		bleMutex.Lock()
+		observeSince(mutexWaitDuration, d.Name, waitStart)
+		acquired := time.Now()
 		slog.Info("Acquired BLE device access", "device", d.Name)
 
 		success := false
 		criticalError := false
 
 		// Step 1: Connect to device
+		stateStore.SetPoll(d.Name, PollConnecting)
 		connected := d.connectToDevice()
 		if !connected {
 			consecutiveFailures++
 		} else {
 			// Step 2: Perform device operations if connected
+			stateStore.SetPoll(d.Name, PollReading)
 			dataSuccess, err := d.handleDeviceOperation()
 
 			if dataSuccess {
@@ -217,12 +356,26 @@ func RegisterHandler(d Device) {
 			}
 		}
 
+		if success {
+			failureStreak = 0
+		} else {
+			failureStreak++
+			streamHub.Publish(Event{
+				Type:   EventFailed,
+				Device: d.Name,
+				Detail: fmt.Sprintf("%d consecutive failures", failureStreak),
+			})
+		}
+		SetConsecutiveFailures(d.Name, failureStreak)
+
 		// Step 3: Check if device reset is needed
 		needsReset := d.checkForResetNeeds(consecutiveFailures, criticalError)
 
 		// Step 4: Release BLE device access
 		slog.Info("Releasing BLE device access", "device", d.Name)
+		observeSince(mutexHoldDuration, d.Name, acquired)
 		bleMutex.Unlock()
+		stateStore.SetPoll(d.Name, PollIdle)
 
 		// Step 5: Wait for reset if needed
 		if needsReset && IsBLEDeviceResetRequested() {
@@ -235,7 +388,7 @@ func RegisterHandler(d Device) {
 		if consecutiveFailures >= maxConsecutiveFailures {
 			slog.Warn("Multiple consecutive failures",
 				"device", d.Name,
-				"failureCount", consecutiveFailures,
+				"failureCount", failureStreak,
 				"status", "device may be offline or have issues")
 
 			// Reset counter to avoid log spam but continue trying
@@ -258,13 +411,45 @@ func (d *Device) pub(c ble.UUID, b []byte) {
 		"device", d.Name,
 		"uuid", c.String(),
 		"value", b)
-	if p, err := d.Client.DiscoverProfile(true); err == nil {
-		if u := p.Find(ble.NewCharacteristic(c)); u != nil {
-			c := u.(*ble.Characteristic)
-			if err := d.Client.WriteCharacteristic(c, b, false); err != nil {
-				slog.Error("Error writing characteristic", "error", err)
-			}
+	p, err := d.Client.DiscoverProfile(true)
+	if err != nil {
+		slog.Error("Discover profile error",
+			"device", d.Name,
+			"error", err)
+		recordError(d.Name, StageDiscover)
+		return
+	}
+
+	// The CCCD is a descriptor of the data characteristic, not a characteristic of its own
+	if c.Equal(cccdUUID) {
+		dc := findCharacteristic(p, d.Model.Service, d.Model.Characteristic)
+		if dc == nil || dc.CCCD == nil {
+			slog.Error("Data characteristic has no CCCD", "device", d.Name)
+			recordError(d.Name, StageWriteCCCD)
+			return
 		}
+		if err := d.Client.WriteDescriptor(dc.CCCD, b); err != nil {
+			slog.Error("Error writing CCCD",
+				"device", d.Name,
+				"error", err)
+			recordError(d.Name, StageWriteCCCD)
+		}
+		return
+	}
+
+	u, ok := p.Find(ble.NewCharacteristic(c)).(*ble.Characteristic)
+	if !ok {
+		slog.Error("Characteristic not found",
+			"device", d.Name,
+			"uuid", c.String())
+		recordError(d.Name, StageWriteCCCD)
+		return
+	}
+	if err := d.Client.WriteCharacteristic(u, b, false); err != nil {
+		slog.Error("Error writing characteristic",
+			"device", d.Name,
+			"error", err)
+		recordError(d.Name, StageWriteCCCD)
 	}
 }
 
@@ -300,13 +485,13 @@ func (d *Device) performWithRetry(operation string, maxRetries int,
 }
 
 // subscribeToCharacteristic subscribes to a characteristic with retries
-func (d *Device) subscribeToCharacteristic(characteristic *ble.Characteristic, maxRetries int) (success bool, localErrors int) {
+func (d *Device) subscribeToCharacteristic(characteristic *ble.Characteristic, handler func(req []byte), maxRetries int) (success bool, localErrors int) {
 	slog.Info("Subscribing to characteristic",
 		"device", d.Name,
 		"handle", characteristic.Handle)
 
 	subscribeAction := func() error {
-		return d.Client.Subscribe(characteristic, false, handlerPublisher(d.Name))
+		return d.Client.Subscribe(characteristic, false, timeFirstNotification(d.Name, handler))
 	}
 
 	onError := func(err error) {
@@ -318,6 +503,7 @@ func (d *Device) subscribeToCharacteristic(characteristic *ble.Characteristic, m
 
 		localErrors++
 		totalErrors := IncrementErrors(d.Name)
+		recordError(d.Name, StageSubscribe)
 
 		slog.Info("Tracked error",
 			"device", d.Name,
@@ -356,6 +542,7 @@ func (d *Device) unsubscribeFromCharacteristic(characteristic *ble.Characteristi
 
 		localErrors++
 		totalErrors := IncrementErrors(d.Name)
+		recordError(d.Name, StageUnsubscribe)
 
 		slog.Info("Tracked error",
 			"device", d.Name,
@@ -393,6 +580,7 @@ func (d *Device) discoverDeviceProfile(maxRetries int) (*ble.Profile, int) {
 
 		localErrors++
 		totalErrors := IncrementErrors(d.Name)
+		recordError(d.Name, StageDiscover)
 
 		slog.Info("Tracked error",
 			"device", d.Name,
@@ -401,7 +589,9 @@ func (d *Device) discoverDeviceProfile(maxRetries int) (*ble.Profile, int) {
 			"errorType", "discover_profile")
 	}
 
+	start := time.Now()
 	success := d.performWithRetry("profile discovery", maxRetries, discoverAction, onError)
+	observeSince(discoverDuration, d.Name, start)
 
 	if success {
 		// Reset error counter on success (only on first try)
@@ -418,20 +608,25 @@ func (d *Device) discoverDeviceProfile(maxRetries int) (*ble.Profile, int) {
 	return nil, localErrors
 }
 
-func (d *Device) readSensorData(c ble.UUID) bool {
-	slog.Info("Reading sensor data", "device", d.Name, "uuid", c.String())
+// readSensorData reads the device details and subscribes to readings using a discovered profile
+func (d *Device) readSensorData(profile *ble.Profile, svc, c ble.UUID) bool {
+	slog.Info("Reading sensor data",
+		"device", d.Name,
+		"model", d.Model.Name,
+		"uuid", c.String())
 
-	// Step 1: Discover device profile
+	// Step 1: The profile was discovered when the session started
 	maxRetries := 3
-	profile, errors := d.discoverDeviceProfile(maxRetries)
-	if profile == nil {
-		return false
-	}
+	errors := 0
 
-	// Step 2: Find the characteristic
-	if u := profile.Find(ble.NewCharacteristic(c)); u != nil {
-		characteristic := u.(*ble.Characteristic)
+	// Read firmware and hardware details, cached between sessions
+	d.readDeviceInfo(profile)
+
+	// Prefer the battery level reported by the device over the discharge curve
+	d.readBatteryLevel(profile)
 
+	// Step 2: Find the characteristic
+	if characteristic := findCharacteristic(profile, svc, c); characteristic != nil {
 		// Check if this characteristic supports notifications and has CCCD
 		if (characteristic.Property&ble.CharNotify) != 0 && characteristic.CCCD != nil {
 			slog.Info("Registering Temperature|Humidity Handler",
@@ -439,22 +634,42 @@ func (d *Device) readSensorData(c ble.UUID) bool {
 				"handle", characteristic.Handle)
 
 			// Step 3: Subscribe to notifications
-			subscribed, subErrors := d.subscribeToCharacteristic(characteristic, maxRetries)
+			session := newNotificationSession(d, *notificationSamples)
+			subscribed, subErrors := d.subscribeToCharacteristic(characteristic, session.handle, maxRetries)
 			errors += subErrors
 
 			if !subscribed {
 				return false
 			}
 
-			// Step 4: Wait for data
-			time.Sleep(6 * time.Second)
+			// Step 4: Wait for enough notifications or the window to end
+			readings := session.wait(time.Duration(*notificationTimeout) * time.Second)
 
 			// Step 5: Unsubscribe
 			errors += d.unsubscribeFromCharacteristic(characteristic, maxRetries)
 
+			// Step 6: Publish one reading for the whole window
+			if r := AggregateReadings(readings, *notificationAggregate); r != nil {
+				slog.Info("Aggregated sensor data",
+					"device", d.Name,
+					"notifications", len(readings),
+					"method", *notificationAggregate,
+					"reading", r.String())
+				publishReading(d, r, d.Model)
+			} else {
+				// A silent device counts as a failed poll for the streak, backoff and readiness
+				slog.Warn("No notification received", "device", d.Name)
+				recordError(d.Name, StageNoData)
+				return false
+			}
+
 			return true // Successfully read data
 		}
 	}
 
+	slog.Error("Data characteristic not found or not notifiable",
+		"device", d.Name,
+		"uuid", c.String())
+	recordError(d.Name, StageDiscover)
 	return false // Failed to find characteristic
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/currantlabs/ble"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeClient is a GATT client whose profile is only available after discovery,
+// like gatt.Client after a new connection
+type fakeClient struct {
+	ble.Client
+	profile    *ble.Profile
+	discovered bool
+	reads      map[string][]byte
+	rssi       int
+}
+
+func (c *fakeClient) Profile() *ble.Profile {
+	if !c.discovered {
+		return nil
+	}
+	return c.profile
+}
+
+func (c *fakeClient) DiscoverProfile(bool) (*ble.Profile, error) {
+	c.discovered = true
+	return c.profile, nil
+}
+
+func (c *fakeClient) ReadCharacteristic(ch *ble.Characteristic) ([]byte, error) {
+	return c.reads[ch.UUID.String()], nil
+}
+
+func (c *fakeClient) WriteCharacteristic(*ble.Characteristic, []byte, bool) error { return nil }
+func (c *fakeClient) WriteDescriptor(*ble.Descriptor, []byte) error               { return nil }
+func (c *fakeClient) ReadRSSI() int                                               { return c.rssi }
+func (c *fakeClient) CancelConnection() error                                     { return nil }
+
+func (c *fakeClient) Subscribe(*ble.Characteristic, bool, ble.NotificationHandler) error {
+	return nil
+}
+
+func (c *fakeClient) Unsubscribe(*ble.Characteristic, bool) error { return nil }
+
+func TestHandleDeviceOperationAppliesSettingsWithProfile(t *testing.T) {
+	model, err := LookupModel(DefaultModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &fakeClient{
+		profile: &ble.Profile{Services: []*ble.Service{{
+			UUID: xiaomiDataServiceUUID,
+			Characteristics: []*ble.Characteristic{
+				{UUID: xiaomiUnitsUUID, Property: ble.CharRead | ble.CharWrite},
+			},
+		}}},
+		reads: map[string][]byte{xiaomiUnitsUUID.String(): {0x00}},
+	}
+	d := &Device{
+		Name:     "settings-order",
+		Model:    model,
+		Firmware: FirmwareStock,
+		Settings: map[string]string{SettingDisplayUnit: "C"},
+		Client:   client,
+	}
+
+	d.handleDeviceOperation()
+
+	if got := testutil.ToFloat64(settingWritesCounter.WithLabelValues(d.Name, SettingDisplayUnit, "failure")); got != 0 {
+		t.Errorf("setting failed %v times, profile not discovered before applying settings", got)
+	}
+	if got := testutil.ToFloat64(settingInSync.WithLabelValues(d.Name, SettingDisplayUnit)); got != 1 {
+		t.Errorf("setting in sync = %v, want 1", got)
+	}
+}
+
+func TestReadSensorDataWithoutNotifications(t *testing.T) {
+	saved := *notificationTimeout
+	*notificationTimeout = 1
+	t.Cleanup(func() { *notificationTimeout = saved })
+
+	model, err := LookupModel(DefaultModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := &ble.Characteristic{
+		UUID:     xiaomiDataUUID,
+		Property: ble.CharNotify,
+		CCCD:     &ble.Descriptor{UUID: cccdUUID},
+	}
+	profile := &ble.Profile{Services: []*ble.Service{{
+		UUID:            xiaomiDataServiceUUID,
+		Characteristics: []*ble.Characteristic{data},
+	}}}
+	d := &Device{
+		Name:   "silent",
+		Model:  model,
+		Client: &fakeClient{profile: profile},
+	}
+
+	if d.readSensorData(profile, model.Service, model.Characteristic) {
+		t.Error("poll without notifications reported as successful")
+	}
+}
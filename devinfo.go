@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/currantlabs/ble"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Device information is re-read after this long to pick up firmware updates
+const deviceInfoRefreshInterval = 24 * time.Hour
+
+var (
+	// Device Information Service and its string characteristics
+	deviceInfoServiceUUID = ble.UUID16(0x180a)
+	deviceInfoFields      = []struct {
+		Label string
+		UUID  ble.UUID
+	}{
+		{"manufacturer", ble.UUID16(0x2a29)},
+		{"model", ble.UUID16(0x2a24)},
+		{"serial", ble.UUID16(0x2a25)},
+		{"firmware", ble.UUID16(0x2a26)},
+		{"hardware", ble.UUID16(0x2a27)},
+	}
+
+	deviceInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mi_device_info",
+		Help: "MI device information from the Device Information Service",
+	},
+		[]string{"location", "manufacturer", "model", "serial", "firmware", "hardware"})
+
+	deviceInfoCache      = make(map[string]*DeviceInfo)
+	deviceInfoCacheMutex sync.Mutex
+)
+
+// DeviceInfo holds the Device Information Service values of a device
+type DeviceInfo struct {
+	Values map[string]string
+	Read   time.Time
+}
+
+// GetDeviceInfo returns the cached device information of a device, if any
+func GetDeviceInfo(deviceName string) *DeviceInfo {
+	deviceInfoCacheMutex.Lock()
+	defer deviceInfoCacheMutex.Unlock()
+	return deviceInfoCache[deviceName]
+}
+
+// readDeviceInfo reads the Device Information Service unless a recent copy is cached
+func (d *Device) readDeviceInfo(p *ble.Profile) {
+	if info := GetDeviceInfo(d.Name); info != nil && time.Since(info.Read) < deviceInfoRefreshInterval {
+		return
+	}
+
+	info := &DeviceInfo{
+		Values: make(map[string]string),
+		Read:   time.Now(),
+	}
+	found := false
+	for _, f := range deviceInfoFields {
+		c := findCharacteristic(p, deviceInfoServiceUUID, f.UUID)
+		if c == nil || c.Property&ble.CharRead == 0 {
+			continue
+		}
+		b, err := d.Client.ReadCharacteristic(c)
+		if err != nil {
+			slog.Warn("Error reading device information",
+				"device", d.Name,
+				"field", f.Label,
+				"error", err)
+			continue
+		}
+		info.Values[f.Label] = strings.TrimRight(string(b), "\x00 ")
+		found = true
+	}
+	if !found {
+		slog.Debug("No device information available", "device", d.Name)
+		return
+	}
+
+	slog.Info("Read device information",
+		"device", d.Name,
+		"info", info.Values)
+
+	deviceInfoCacheMutex.Lock()
+	deviceInfoCache[d.Name] = info
+	deviceInfoCacheMutex.Unlock()
+
+	labels := prometheus.Labels{"location": d.Name}
+	deviceInfo.DeletePartialMatch(labels)
+	for _, f := range deviceInfoFields {
+		labels[f.Label] = info.Values[f.Label]
+	}
+	deviceInfo.With(labels).Set(1)
+}
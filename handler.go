@@ -4,62 +4,181 @@ import (
 	"encoding/hex"
 	"log/slog"
 	"math"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+// Aggregation methods for the readings of one subscribe window
+const (
+	AggregateLast   = "last"
+	AggregateMean   = "mean"
+	AggregateMedian = "median"
+)
+
 var (
-	temperature = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "mi_temperature",
-		Help: "MI sensor temperature",
-	},
-		[]string{"location"})
-	humidity = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "mi_humidity",
-		Help: "MI sensor humidity",
-	},
-		[]string{"location"})
-	voltage = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "mi_voltage",
-		Help: "MI sensor battery voltage",
+	notificationsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mi_notifications_total",
+		Help: "MI sensor notifications decoded",
 	},
 		[]string{"location"})
-	battery = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "mi_battery",
-		Help: "MI sensor battery level",
+	sessionNotifications = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mi_poll_notifications",
+		Help: "MI sensor notifications decoded in the last subscribe window",
 	},
 		[]string{"location"})
 )
 
-func handlerPublisher(name string) func(req []byte) {
-	return func(req []byte) {
-		s := hex.EncodeToString(req)
-		r, err := Unmarshall(req)
-		if err != nil {
-			slog.Error("Unable to unmarshal data",
-				"device", name,
-				"data", s,
-				"error", err)
-			return
-		}
+// notificationSession collects the readings notified during one subscribe window
+type notificationSession struct {
+	d    *Device
+	want int
 
-		slog.Info("Received sensor data",
-			"device", name,
-			"temperature", r.Temperature,
-			"humidity", r.Humidity,
-			"voltage", r.Voltage,
-			"rawData", s)
-
-		temperature.WithLabelValues(name).Set(r.Temperature)
-		humidity.WithLabelValues(name).Set(r.Humidity)
-		voltage.WithLabelValues(name).Set(r.Voltage)
-		// 3.1V or above --> 100% 2.1V --> 0 %
-		batteryPercent := math.Round(math.Min((r.Voltage-2.1)*100, 100)*100) / 100
-		battery.WithLabelValues(name).Set(batteryPercent)
-
-		slog.Info("Updated metrics",
+	mu       sync.Mutex
+	readings []*Reading
+	done     chan struct{}
+}
+
+// newNotificationSession returns a session that completes after want readings.
+// With want 0 the session only ends at the timeout.
+func newNotificationSession(d *Device, want int) *notificationSession {
+	return &notificationSession{
+		d:    d,
+		want: want,
+		done: make(chan struct{}),
+	}
+}
+
+// handle decodes one notification and adds it to the session
+func (s *notificationSession) handle(req []byte) {
+	name, m := s.d.Name, s.d.Model
+	data := hex.EncodeToString(req)
+	r, err := m.Decode(req)
+	if err != nil {
+		slog.Error("Unable to unmarshal data",
 			"device", name,
-			"batteryPercent", batteryPercent)
+			"data", data,
+			"error", err)
+		recordError(name, StageDecode)
+		return
+	}
+
+	slog.Info("Received sensor data",
+		"device", name,
+		"temperature", r.Temperature,
+		"humidity", r.Humidity,
+		"voltage", r.Voltage,
+		"rawData", data)
+	notificationsCounter.WithLabelValues(name).Inc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readings = append(s.readings, r)
+	if s.want > 0 && len(s.readings) == s.want {
+		close(s.done)
+	}
+}
+
+// wait blocks until enough readings arrived or timeout passed and returns the readings
+func (s *notificationSession) wait(timeout time.Duration) []*Reading {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-s.done:
+	case <-timer.C:
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessionNotifications.WithLabelValues(s.d.Name).Set(float64(len(s.readings)))
+	return append([]*Reading(nil), s.readings...)
+}
+
+// AggregateReadings combines the readings of one window into a single Reading
+func AggregateReadings(readings []*Reading, method string) *Reading {
+	if len(readings) == 0 {
+		return nil
 	}
+
+	var combine func(values []float64) float64
+	switch method {
+	case AggregateMean:
+		combine = func(values []float64) float64 {
+			sum := 0.0
+			for _, v := range values {
+				sum += v
+			}
+			return sum / float64(len(values))
+		}
+	case AggregateMedian:
+		combine = func(values []float64) float64 {
+			sort.Float64s(values)
+			n := len(values)
+			if n%2 == 1 {
+				return values[n/2]
+			}
+			return (values[n/2-1] + values[n/2]) / 2
+		}
+	default:
+		return readings[len(readings)-1]
+	}
+
+	field := func(get func(r *Reading) float64) float64 {
+		values := make([]float64, len(readings))
+		for i, r := range readings {
+			values[i] = get(r)
+		}
+		return math.Round(combine(values)*1000) / 1000
+	}
+	return &Reading{
+		Temperature: field(func(r *Reading) float64 { return r.Temperature }),
+		Humidity:    field(func(r *Reading) float64 { return r.Humidity }),
+		Voltage:     field(func(r *Reading) float64 { return r.Voltage }),
+	}
+}
+
+// publishReading publishes the measurements the model supports from a decoded Reading
+func publishReading(d *Device, r *Reading, m *Model) {
+	values := make(map[string]float64)
+	if m.Supports("temperature") {
+		values["temperature"] = r.Temperature
+	}
+	if m.Supports("humidity") {
+		values["humidity"] = r.Humidity
+	}
+	if m.Supports("voltage") {
+		values["voltage"] = r.Voltage
+	}
+	if m.Supports("battery") {
+		values["battery"] = d.batteryPercent(r.Voltage)
+	}
+
+	publishMeasurements(d, values)
+}
+
+// publishMeasurements stores the calibrated and derived measurements of one reading as a single update
+func publishMeasurements(d *Device, values map[string]float64) {
+	name := d.Name
+	d.calibrate(values)
+	deriveClimate(name, values)
+	for measurement, value := range d.Link {
+		values[measurement] = value
+	}
+
+	for measurement := range values {
+		if _, ok := sensorMetrics[measurement]; !ok {
+			slog.Debug("Ignoring unsupported measurement",
+				"device", name,
+				"measurement", measurement)
+			delete(values, measurement)
+		}
+	}
+	stateStore.Update(name, values, time.Now())
+
+	slog.Info("Updated metrics",
+		"device", name,
+		"measurements", values)
 }
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAggregateReadings(t *testing.T) {
+	readings := []*Reading{
+		{Temperature: 21.5, Humidity: 40, Voltage: 2.9},
+		{Temperature: 23.0, Humidity: 44, Voltage: 3.0},
+		{Temperature: 21.0, Humidity: 41, Voltage: 2.95},
+		{Temperature: 22.0, Humidity: 43, Voltage: 2.95},
+	}
+	tests := []struct {
+		name     string
+		readings []*Reading
+		method   string
+		want     *Reading
+	}{
+		{"empty", nil, AggregateMean, nil},
+		{"last", readings, AggregateLast, &Reading{Temperature: 22.0, Humidity: 43, Voltage: 2.95}},
+		{"mean", readings, AggregateMean, &Reading{Temperature: 21.875, Humidity: 42, Voltage: 2.95}},
+		{"median even", readings, AggregateMedian, &Reading{Temperature: 21.75, Humidity: 42, Voltage: 2.95}},
+		{"median odd", readings[:3], AggregateMedian, &Reading{Temperature: 21.5, Humidity: 41, Voltage: 2.95}},
+		{"single", readings[:1], AggregateMedian, &Reading{Temperature: 21.5, Humidity: 40, Voltage: 2.9}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AggregateReadings(tt.readings, tt.method); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AggregateReadings = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// The readings of the session must not be reordered by the median
+	if readings[0].Temperature != 21.5 || readings[3].Temperature != 22.0 {
+		t.Error("readings modified by the aggregation")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// monitorStallAfter is how long the reset monitor may go without a check before the process is unhealthy.
+// It covers the monitor interval plus the back-off after a failed reset.
+const monitorStallAfter = 2 * time.Minute
+
+var (
+	startTime = time.Now()
+
+	// Unix nanoseconds of the last reset monitor check and of the last sensor reading
+	monitorHeartbeat atomic.Int64
+	lastReading      atomic.Int64
+)
+
+// resetMonitorTick records that the reset monitor loop is still running
+func resetMonitorTick() {
+	monitorHeartbeat.Store(time.Now().UnixNano())
+}
+
+// recordReading remembers when any sensor last reported. It is a StateStore Listener.
+func recordReading(name string, values map[string]float64, t time.Time) {
+	lastReading.Store(time.Now().UnixNano())
+}
+
+// sinceOrStart returns the time since a recorded moment, or since start when nothing was recorded yet
+func sinceOrStart(nanos int64) time.Duration {
+	if nanos == 0 {
+		return time.Since(startTime)
+	}
+	return time.Since(time.Unix(0, nanos))
+}
+
+// healthProblems returns why the process is not healthy, empty when it is
+func healthProblems() []string {
+	var problems []string
+	if age := sinceOrStart(monitorHeartbeat.Load()); age > monitorStallAfter {
+		problems = append(problems, fmt.Sprintf("reset monitor stalled for %s", age.Round(time.Second)))
+	}
+	return problems
+}
+
+// readinessProblems returns why the exporter cannot serve fresh readings, empty when it can
+func readinessProblems() []string {
+	problems := healthProblems()
+	if !AdapterUp() {
+		problems = append(problems, "BLE adapter is not available")
+	}
+	if since, pending := BLEDeviceResetRequestedAt(); pending {
+		if age := time.Since(since); age > time.Duration(*readyResetTimeout)*time.Second {
+			problems = append(problems, fmt.Sprintf("BLE reset requested by %s pending for %s",
+				BLEDeviceResetTrigger(), age.Round(time.Second)))
+		}
+	}
+	if *readyReadingTimeout > 0 {
+		if age := sinceOrStart(lastReading.Load()); age > time.Duration(*readyReadingTimeout)*time.Second {
+			problems = append(problems, fmt.Sprintf("no sensor reading for %s", age.Round(time.Second)))
+		}
+	}
+	return problems
+}
+
+// writeProbe answers a probe with 200 and ok, or 503 and one problem per line
+func writeProbe(w http.ResponseWriter, problems []string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(problems, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// healthzHandler reports whether the process is alive
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeProbe(w, healthProblems())
+}
+
+// readyzHandler reports whether the BLE adapter works and sensors are reporting
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	writeProbe(w, readinessProblems())
+}
+
+// runHealthcheck queries the probe at path, /readyz by default, of the exporter listening on
+// listenAddress and returns the process exit code
+func runHealthcheck(listenAddress, path string) int {
+	if path == "" {
+		path = "/readyz"
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	host, port, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		slog.Error("Invalid listen address", "address", listenAddress, "error", err)
+		return 1
+	}
+	// A wildcard listener is reachable on loopback
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + net.JoinHostPort(host, port) + path)
+	if err != nil {
+		slog.Error("Healthcheck failed", "error", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode != http.StatusOK {
+		slog.Error("Healthcheck failed",
+			"status", resp.Status,
+			"problems", strings.TrimSpace(string(body)))
+		return 1
+	}
+	return 0
+}
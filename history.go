@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/currantlabs/ble"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// Hourly records kept per device, about one month
+	maxHistoryRecords = 24 * 31
+	// History is recorded hourly, so there is no point downloading it more often
+	historyDownloadInterval = time.Hour
+	// Download ends when no record arrived for this long
+	historyIdleTimeout = 3 * time.Second
+	// Hourly downloads without any record after which the device is assumed to have restarted its index
+	historyReseedDownloads = 3
+)
+
+var (
+	// Xiaomi history characteristics: start index for the download and record notifications
+	xiaomiHistoryIndexUUID = ble.MustParse("ebe0ccba-7a0a-4b0c-8a1a-6ff2997da3a6")
+	xiaomiHistoryUUID      = ble.MustParse("ebe0ccbc-7a0a-4b0c-8a1a-6ff2997da3a6")
+
+	historyLastIndex = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mi_history_last_index",
+		Help: "Index of the last history record downloaded from the MI sensor",
+	},
+		[]string{"location"})
+	historyLastRecord = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mi_history_last_record_timestamp_seconds",
+		Help: "Timestamp of the last history record downloaded from the MI sensor",
+	},
+		[]string{"location"})
+	historyRecordsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mi_history_records_total",
+		Help: "MI sensor history records downloaded",
+	},
+		[]string{"location"})
+
+	historyStore *HistoryStore
+)
+
+// HistoryRecord represents an hourly min/max record stored on the sensor
+type HistoryRecord struct {
+	Index          uint32    `json:"index"`
+	Time           time.Time `json:"time"`
+	MinTemperature float64   `json:"minTemperature"`
+	MaxTemperature float64   `json:"maxTemperature"`
+	MinHumidity    float64   `json:"minHumidity"`
+	MaxHumidity    float64   `json:"maxHumidity"`
+}
+
+// UnmarshallHistory converts an encoded history record into a HistoryRecord
+func UnmarshallHistory(req []byte) (*HistoryRecord, error) {
+	// 00-03 04-07 08 09 10 11 12 13
+	// IDX   TS    T2 T1 HX T2 T1 HX
+	l := len(req)
+	if l != 14 {
+		return &HistoryRecord{}, fmt.Errorf("Expecting 14 bytes got %d", l)
+	}
+	return &HistoryRecord{
+		Index:          binary.LittleEndian.Uint32(req[0:4]),
+		Time:           time.Unix(int64(binary.LittleEndian.Uint32(req[4:8])), 0).UTC(),
+		MaxTemperature: float64(int16(binary.LittleEndian.Uint16(req[8:10]))) / 10.0,
+		MaxHumidity:    float64(req[10]),
+		MinTemperature: float64(int16(binary.LittleEndian.Uint16(req[11:13]))) / 10.0,
+		MinHumidity:    float64(req[13]),
+	}, nil
+}
+
+// deviceHistory holds the downloaded history of a device
+type deviceHistory struct {
+	LastIndex    uint32          `json:"lastIndex"`
+	HasIndex     bool            `json:"hasIndex"`
+	Records      []HistoryRecord `json:"records"`
+	LastDownload time.Time       `json:"lastDownload"`
+	// EmptyDownloads counts downloads in a row that returned no record
+	EmptyDownloads int `json:"emptyDownloads"`
+}
+
+// HistoryStore keeps downloaded history records and persists the last index per device
+type HistoryStore struct {
+	mu      sync.Mutex
+	path    string
+	devices map[string]*deviceHistory
+}
+
+// NewHistoryStore returns a HistoryStore loaded from path. An empty path keeps history in memory.
+func NewHistoryStore(path string) (*HistoryStore, error) {
+	h := &HistoryStore{
+		path:    path,
+		devices: make(map[string]*deviceHistory),
+	}
+	if path == "" {
+		return h, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &h.devices); err != nil {
+		return nil, fmt.Errorf("can't parse history state %s: %w", path, err)
+	}
+	for name, dh := range h.devices {
+		if dh.HasIndex {
+			historyLastIndex.WithLabelValues(name).Set(float64(dh.LastIndex))
+		}
+	}
+	return h, nil
+}
+
+// device returns the history of a device, creating it if needed. Caller must hold mu.
+func (h *HistoryStore) device(name string) *deviceHistory {
+	dh, ok := h.devices[name]
+	if !ok {
+		dh = &deviceHistory{}
+		h.devices[name] = dh
+	}
+	return dh
+}
+
+// Due reports whether the history of a device should be downloaded
+func (h *HistoryStore) Due(name string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Since(h.device(name).LastDownload) >= historyDownloadInterval
+}
+
+// NextIndex returns the index to start the next download from
+func (h *HistoryStore) NextIndex(name string) uint32 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	dh := h.device(name)
+	if !dh.HasIndex {
+		return 0
+	}
+	return dh.LastIndex + 1
+}
+
+// Add stores records downloaded in index order and persists the last index and download time of a device
+func (h *HistoryStore) Add(name string, records []HistoryRecord) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	dh := h.device(name)
+	dh.LastDownload = time.Now()
+
+	// The index starts again from 0 after a restart or battery swap. The device then either sends
+	// only records below the last index, or nothing at all for an index it has not reached yet.
+	if dh.HasIndex {
+		switch {
+		case len(records) > 0 && records[len(records)-1].Index <= dh.LastIndex:
+			slog.Warn("History index went backwards, assuming the device restarted",
+				"device", name,
+				"lastIndex", dh.LastIndex,
+				"index", records[len(records)-1].Index)
+			dh.HasIndex = false
+		case len(records) == 0:
+			dh.EmptyDownloads++
+			if dh.EmptyDownloads >= historyReseedDownloads {
+				slog.Warn("No history records after several downloads, restarting from the first index",
+					"device", name,
+					"lastIndex", dh.LastIndex,
+					"downloads", dh.EmptyDownloads)
+				dh.HasIndex = false
+				dh.EmptyDownloads = 0
+			}
+		}
+	}
+	if len(records) > 0 {
+		dh.EmptyDownloads = 0
+	}
+
+	for _, r := range records {
+		if dh.HasIndex && r.Index <= dh.LastIndex {
+			continue
+		}
+		dh.Records = append(dh.Records, r)
+		dh.LastIndex = r.Index
+		dh.HasIndex = true
+		historyRecordsCounter.WithLabelValues(name).Inc()
+		historyLastRecord.WithLabelValues(name).Set(float64(r.Time.Unix()))
+	}
+	if len(dh.Records) > maxHistoryRecords {
+		dh.Records = dh.Records[len(dh.Records)-maxHistoryRecords:]
+	}
+	historyLastIndex.WithLabelValues(name).Set(float64(dh.LastIndex))
+
+	return h.save()
+}
+
+// Records returns the stored records of a device newer than since
+func (h *HistoryStore) Records(name string, since time.Time) []HistoryRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	records := []HistoryRecord{}
+	if dh, ok := h.devices[name]; ok {
+		for _, r := range dh.Records {
+			if r.Time.After(since) {
+				records = append(records, r)
+			}
+		}
+	}
+	return records
+}
+
+// save writes the store to disk. Caller must hold mu.
+func (h *HistoryStore) save() error {
+	if h.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(h.devices)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0o755); err != nil {
+		return err
+	}
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path)
+}
+
+// readHistory downloads the history records stored on the device since the last download
+func (d *Device) readHistory() bool {
+	if !d.History || d.Model.History == nil || historyStore == nil || !historyStore.Due(d.Name) {
+		return true
+	}
+
+	profile := d.Client.Profile()
+	if profile == nil {
+		return false
+	}
+	indexChar := findCharacteristic(profile, d.Model.Service, d.Model.HistoryIndex)
+	historyChar := findCharacteristic(profile, d.Model.Service, d.Model.History)
+	if indexChar == nil || historyChar == nil || historyChar.CCCD == nil {
+		slog.Warn("History characteristics not found", "device", d.Name)
+		return false
+	}
+
+	// Step 1: Select the first record to download
+	start := historyStore.NextIndex(d.Name)
+	slog.Info("Downloading history", "device", d.Name, "startIndex", start)
+	idx := make([]byte, 4)
+	binary.LittleEndian.PutUint32(idx, start)
+	if err := d.Client.WriteCharacteristic(indexChar, idx, false); err != nil {
+		slog.Error("Error writing history index",
+			"device", d.Name,
+			"error", err)
+		return false
+	}
+
+	// Step 2: Collect record notifications until the device goes quiet
+	var mu sync.Mutex
+	records := []HistoryRecord{}
+	received := make(chan struct{}, 1)
+	handler := func(req []byte) {
+		r, err := d.Model.DecodeHistory(req)
+		if err != nil {
+			slog.Error("Unable to unmarshal history record",
+				"device", d.Name,
+				"data", hex.EncodeToString(req),
+				"error", err)
+			return
+		}
+		mu.Lock()
+		records = append(records, *r)
+		mu.Unlock()
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+	}
+
+	if err := d.Client.Subscribe(historyChar, false, handler); err != nil {
+		slog.Error("History subscribe error",
+			"device", d.Name,
+			"error", err)
+		return false
+	}
+
+	deadline := time.After(time.Duration(*historyTimeout) * time.Second)
+	idle := time.NewTimer(historyIdleTimeout)
+	defer idle.Stop()
+wait:
+	for {
+		select {
+		case <-received:
+			idle.Reset(historyIdleTimeout)
+		case <-idle.C:
+			break wait
+		case <-deadline:
+			slog.Info("History download time limit reached", "device", d.Name)
+			break wait
+		}
+	}
+
+	if err := d.Client.Unsubscribe(historyChar, false); err != nil {
+		slog.Warn("History unsubscribe error",
+			"device", d.Name,
+			"error", err)
+	}
+
+	// Step 3: Store the records in index order
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Slice(records, func(i, j int) bool { return records[i].Index < records[j].Index })
+	if err := historyStore.Add(d.Name, records); err != nil {
+		slog.Error("Unable to save history state",
+			"device", d.Name,
+			"error", err)
+	}
+
+	slog.Info("Downloaded history",
+		"device", d.Name,
+		"records", len(records))
+	return true
+}
+
+// historyHandler serves the downloaded history records as JSON
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	since := time.Time{}
+	if s := r.URL.Query().Get("since"); s != "" {
+		ts, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid since parameter", http.StatusBadRequest)
+			return
+		}
+		since = time.Unix(ts, 0)
+	}
+
+	result := make(map[string][]HistoryRecord)
+	device := r.URL.Query().Get("device")
+	for _, d := range globalConfig.Devices {
+		if device != "" && d.Name != device {
+			continue
+		}
+		if d.History {
+			result[d.Name] = historyStore.Records(d.Name, since)
+		}
+	}
+	if device != "" && len(result) == 0 {
+		http.Error(w, "unknown device", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		slog.Error("Unable to encode history", "error", err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryStorePersistsDownload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "history.json")
+	h, err := NewHistoryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Due("kitchen") {
+		t.Fatal("new device not due")
+	}
+	if err := h.Add("kitchen", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Add("hall", []HistoryRecord{{Index: 7}}); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err = NewHistoryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Due("kitchen") || h.Due("hall") {
+		t.Error("download time not persisted, history would be downloaded again after a restart")
+	}
+	if got := h.NextIndex("hall"); got != 8 {
+		t.Errorf("NextIndex = %d, want 8", got)
+	}
+}
+
+// record returns a history record with a distinct time for its index
+func record(index uint32) HistoryRecord {
+	return HistoryRecord{Index: index, Time: time.Unix(int64(index)*3600, 0)}
+}
+
+func TestHistoryStoreIndexRestart(t *testing.T) {
+	h, err := NewHistoryStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Add("kitchen", []HistoryRecord{record(99), record(100)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a battery swap the device numbers its records from 0 again
+	if err := h.Add("kitchen", []HistoryRecord{record(0), record(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.NextIndex("kitchen"); got != 2 {
+		t.Errorf("NextIndex after restart = %d, want 2", got)
+	}
+	if got := len(h.Records("kitchen", time.Time{})); got != 4 {
+		t.Errorf("stored %d records, want 4", got)
+	}
+
+	// A device asked for an index it has not reached yet sends nothing
+	if err := h.Add("hall", []HistoryRecord{{Index: 500}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= historyReseedDownloads; i++ {
+		if got := h.NextIndex("hall"); got != 501 {
+			t.Fatalf("NextIndex after %d empty downloads = %d, want 501", i-1, got)
+		}
+		if err := h.Add("hall", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := h.NextIndex("hall"); got != 0 {
+		t.Errorf("NextIndex after %d empty downloads = %d, want 0", historyReseedDownloads, got)
+	}
+}
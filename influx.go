@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/ini.v1"
+)
+
+// udpMaxPayload keeps line protocol datagrams below a typical MTU
+const udpMaxPayload = 1400
+
+var influxLines = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mi_influxdb_lines_total",
+	Help: "Line protocol lines handled by the InfluxDB output by result",
+},
+	[]string{"result"})
+
+// InfluxConfig holds the InfluxDB output settings from the InfluxDB config section
+type InfluxConfig struct {
+	// URL is http(s):// for the v2 write API or udp:// for the v1 UDP listener
+	URL         string
+	Org         string
+	Bucket      string
+	Token       string
+	Measurement string
+
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxBuffer     int
+}
+
+// parseInfluxConfig reads the InfluxDB section
+func parseInfluxConfig(s *ini.Section) (*InfluxConfig, error) {
+	c := &InfluxConfig{
+		URL:           s.Key("url").String(),
+		Org:           s.Key("org").String(),
+		Bucket:        s.Key("bucket").String(),
+		Token:         s.Key("token").String(),
+		Measurement:   s.Key("measurement").MustString("mijia"),
+		BatchSize:     s.Key("batch_size").MustInt(100),
+		FlushInterval: time.Duration(s.Key("flush_interval").MustInt(10)) * time.Second,
+		MaxBuffer:     s.Key("max_buffer").MustInt(10000),
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || c.URL == "" {
+		return nil, fmt.Errorf("influxdb: invalid url %q", c.URL)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if c.Bucket == "" {
+			return nil, fmt.Errorf("influxdb: bucket is required for HTTP writes")
+		}
+	case "udp":
+	default:
+		return nil, fmt.Errorf("influxdb: unsupported url scheme %q", u.Scheme)
+	}
+	if f := s.Key("token_file").String(); f != "" {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("influxdb: %w", err)
+		}
+		c.Token = strings.TrimSpace(string(b))
+	}
+	if c.BatchSize < 1 || c.MaxBuffer < c.BatchSize || c.FlushInterval <= 0 {
+		return nil, fmt.Errorf("influxdb: batch_size, max_buffer and flush_interval must be positive with max_buffer >= batch_size")
+	}
+	return c, nil
+}
+
+// influxEscape escapes line protocol tag keys, tag values and field keys
+var influxEscape = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// influxMeasurementEscape escapes line protocol measurement names
+var influxMeasurementEscape = strings.NewReplacer(",", `\,`, " ", `\ `)
+
+// InfluxWriter batches readings as line protocol and writes them to InfluxDB
+type InfluxWriter struct {
+	config *InfluxConfig
+	naming *MetricNaming
+	client *http.Client
+
+	mu     sync.Mutex
+	buffer []string
+	// trimmed counts lines dropped from the front of buffer
+	trimmed int
+	wake    chan struct{}
+}
+
+// NewInfluxWriter returns an InfluxWriter tagging lines with the device labels of naming
+func NewInfluxWriter(config *InfluxConfig, naming *MetricNaming) *InfluxWriter {
+	return &InfluxWriter{
+		config: config,
+		naming: naming,
+		client: &http.Client{Timeout: 30 * time.Second},
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Line returns the line protocol representation of one reading
+func (w *InfluxWriter) Line(name string, values map[string]float64, t time.Time) string {
+	tags := map[string]string{"location": name}
+	for k, v := range w.naming.DeviceLabels(name) {
+		if v != "" {
+			tags[k] = v
+		}
+	}
+	tagKeys := make([]string, 0, len(tags))
+	for k := range tags {
+		tagKeys = append(tagKeys, k)
+	}
+	sort.Strings(tagKeys)
+	fieldKeys := make([]string, 0, len(values))
+	for k := range values {
+		fieldKeys = append(fieldKeys, k)
+	}
+	sort.Strings(fieldKeys)
+
+	var b strings.Builder
+	b.WriteString(influxMeasurementEscape.Replace(w.config.Measurement))
+	for _, k := range tagKeys {
+		fmt.Fprintf(&b, ",%s=%s", influxEscape.Replace(k), influxEscape.Replace(tags[k]))
+	}
+	for i, k := range fieldKeys {
+		sep := ","
+		if i == 0 {
+			sep = " "
+		}
+		fmt.Fprintf(&b, "%s%s=%s", sep, influxEscape.Replace(k), strconv.FormatFloat(values[k], 'f', -1, 64))
+	}
+	// The v1 UDP listener expects nanoseconds, HTTP writes ask for milliseconds
+	if strings.HasPrefix(w.config.URL, "udp://") {
+		fmt.Fprintf(&b, " %d", t.UnixNano())
+	} else {
+		fmt.Fprintf(&b, " %d", t.UnixMilli())
+	}
+	return b.String()
+}
+
+// Write buffers one reading. It is a StateStore Listener.
+func (w *InfluxWriter) Write(name string, values map[string]float64, t time.Time) {
+	if len(values) == 0 {
+		return
+	}
+	line := w.Line(name, values, t)
+
+	w.mu.Lock()
+	w.buffer = append(w.buffer, line)
+	if over := len(w.buffer) - w.config.MaxBuffer; over > 0 {
+		slog.Warn("InfluxDB buffer full, dropping oldest lines", "dropped", over)
+		influxLines.WithLabelValues("dropped").Add(float64(over))
+		w.buffer = w.buffer[over:]
+		w.trimmed += over
+	}
+	full := len(w.buffer) >= w.config.BatchSize
+	w.mu.Unlock()
+
+	if full {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run flushes the buffer every flush interval or once a batch is full, retrying failed HTTP writes
+func (w *InfluxWriter) Run() {
+	backoff := time.Second
+	for {
+		select {
+		case <-w.wake:
+		case <-time.After(w.config.FlushInterval):
+		}
+
+		for {
+			w.mu.Lock()
+			batch := append([]string(nil), w.buffer[:min(w.config.BatchSize, len(w.buffer))]...)
+			trimmed := w.trimmed
+			w.mu.Unlock()
+			if len(batch) == 0 {
+				break
+			}
+
+			retry, err := w.send(batch)
+			if err != nil && retry {
+				slog.Warn("InfluxDB write failed, retrying",
+					"error", err,
+					"lines", len(batch),
+					"backoff", backoff)
+				time.Sleep(backoff)
+				backoff = min(backoff*2, time.Minute)
+				continue
+			}
+			backoff = time.Second
+
+			if err != nil {
+				slog.Error("InfluxDB write rejected, dropping lines",
+					"error", err,
+					"lines", len(batch))
+				influxLines.WithLabelValues("dropped").Add(float64(len(batch)))
+			} else {
+				influxLines.WithLabelValues("sent").Add(float64(len(batch)))
+			}
+
+			// The buffer may have been trimmed from the front while sending
+			w.mu.Lock()
+			if n := len(batch) - (w.trimmed - trimmed); n > 0 {
+				w.buffer = w.buffer[n:]
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// send writes a batch and reports whether a failure is worth retrying
+func (w *InfluxWriter) send(lines []string) (retry bool, err error) {
+	u, err := url.Parse(w.config.URL)
+	if err != nil {
+		return false, err
+	}
+	if u.Scheme == "udp" {
+		return false, w.sendUDP(u.Host, lines)
+	}
+
+	u = u.JoinPath("api/v2/write")
+	q := u.Query()
+	q.Set("org", w.config.Org)
+	q.Set("bucket", w.config.Bucket)
+	q.Set("precision", "ms")
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.config.Token != "" {
+		req.Header.Set("Authorization", "Token "+w.config.Token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("influxdb returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	default:
+		return false, fmt.Errorf("influxdb returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+}
+
+// sendUDP writes lines to a v1 UDP listener, packing as many lines per datagram as fit.
+// UDP writes are not acknowledged, so they are never retried.
+func (w *InfluxWriter) sendUDP(addr string, lines []string) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var packet bytes.Buffer
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(packet.Bytes())
+		packet.Reset()
+		return err
+	}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > udpMaxPayload {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		packet.WriteString(line)
+		packet.WriteByte('\n')
+	}
+	return flush()
+}
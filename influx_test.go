@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInfluxLine(t *testing.T) {
+	devices := []Device{{Name: "living room,1=a", Labels: map[string]string{"wing room": "north=1", "empty": ""}}}
+	naming, err := NewMetricNaming(defaultNamespace, devices, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.UnixMilli(1700000000123)
+
+	w := NewInfluxWriter(&InfluxConfig{URL: "http://influx:8086", Measurement: "my data,x"}, naming)
+	got := w.Line("living room,1=a", map[string]float64{"temperature": 21.5, "humidity=x": 40, "dew point": -1.25}, ts)
+	want := `my\ data\,x,location=living\ room\,1\=a,wing\ room=north\=1 dew\ point=-1.25,humidity\=x=40,temperature=21.5 1700000000123`
+	if got != want {
+		t.Errorf("line\n got %s\nwant %s", got, want)
+	}
+
+	// The v1 UDP listener takes nanosecond timestamps
+	w = NewInfluxWriter(&InfluxConfig{URL: "udp://influx:8089", Measurement: "mijia"}, naming)
+	got = w.Line("kitchen", map[string]float64{"battery": 87}, ts)
+	if want := "mijia,location=kitchen battery=87 1700000000123000000"; got != want {
+		t.Errorf("UDP line = %s, want %s", got, want)
+	}
+}
+
+func TestInfluxBufferDropsOldest(t *testing.T) {
+	naming, _ := NewMetricNaming(defaultNamespace, nil, false)
+	w := NewInfluxWriter(&InfluxConfig{URL: "http://influx:8086", Measurement: "m", BatchSize: 2, MaxBuffer: 3}, naming)
+	for i := range 5 {
+		w.Write("d", map[string]float64{"n": float64(i)}, time.UnixMilli(int64(i)))
+	}
+	w.Write("d", nil, time.Now())
+
+	want := []string{"m,location=d n=2 2", "m,location=d n=3 3", "m,location=d n=4 4"}
+	if strings.Join(w.buffer, "\n") != strings.Join(want, "\n") {
+		t.Errorf("buffer = %q, want %q", w.buffer, want)
+	}
+	if w.trimmed != 2 {
+		t.Errorf("trimmed = %d, want 2", w.trimmed)
+	}
+}
+
+func TestInfluxWriterBatches(t *testing.T) {
+	requests := make(chan *http.Request, 10)
+	bodies := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		requests <- r
+		bodies <- string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	naming, _ := NewMetricNaming(defaultNamespace, nil, false)
+	w := NewInfluxWriter(&InfluxConfig{
+		URL:           server.URL,
+		Org:           "home",
+		Bucket:        "sensors",
+		Token:         "secret",
+		Measurement:   "m",
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+		MaxBuffer:     10,
+	}, naming)
+	for i := range 5 {
+		w.Write("d", map[string]float64{"n": float64(i)}, time.UnixMilli(int64(i)))
+	}
+	go w.Run()
+
+	for i, want := range []string{
+		"m,location=d n=0 0\nm,location=d n=1 1",
+		"m,location=d n=2 2\nm,location=d n=3 3",
+		"m,location=d n=4 4",
+	} {
+		select {
+		case r := <-requests:
+			if r.URL.Path != "/api/v2/write" || r.URL.Query().Get("bucket") != "sensors" ||
+				r.URL.Query().Get("org") != "home" || r.URL.Query().Get("precision") != "ms" {
+				t.Errorf("request %d to %s", i, r.URL)
+			}
+			if got := r.Header.Get("Authorization"); got != "Token secret" {
+				t.Errorf("request %d authorization = %q", i, got)
+			}
+			if got := <-bodies; got != want {
+				t.Errorf("batch %d = %q, want %q", i, got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("batch %d not written", i)
+		}
+	}
+}
+
+func TestInfluxUDPPackets(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	naming, _ := NewMetricNaming(defaultNamespace, nil, false)
+	w := NewInfluxWriter(&InfluxConfig{URL: "udp://" + conn.LocalAddr().String()}, naming)
+	line := strings.Repeat("x", 600)
+	if err := w.sendUDP(conn.LocalAddr().String(), []string{line, line, line, line, line}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 65536)
+	var counts []int
+	for total := 0; total < 5; {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > udpMaxPayload {
+			t.Errorf("datagram of %d bytes exceeds %d", n, udpMaxPayload)
+		}
+		lines := strings.Count(string(buf[:n]), "\n")
+		counts = append(counts, lines)
+		total += lines
+	}
+	if len(counts) != 3 || counts[0] != 2 || counts[1] != 2 || counts[2] != 1 {
+		t.Errorf("lines per datagram = %v, want [2 2 1]", counts)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/ini.v1"
+)
+
+// defaultNamespace is the metric name prefix used in the code
+const defaultNamespace = "mi"
+
+var (
+	labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	namespaceRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+)
+
+// reservedLabels are set by the exporter or have a meaning in Prometheus histograms and summaries
+var reservedLabels = map[string]bool{
+	"location": true,
+	"le":       true,
+	"quantile": true,
+}
+
+// validLabelName reports whether name can be used as a custom device label
+func validLabelName(name string) bool {
+	return labelNameRE.MatchString(name) && !strings.HasPrefix(name, "__") && !reservedLabels[name]
+}
+
+// parseLabels reads the label_<name> keys of a section
+func parseLabels(s *ini.Section) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, key := range s.Keys() {
+		name, ok := strings.CutPrefix(key.Name(), "label_")
+		if !ok {
+			continue
+		}
+		if !validLabelName(name) {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		labels[name] = key.String()
+	}
+	return labels, nil
+}
+
+// MetricNaming holds the exported metric namespace and the custom labels of each device
+type MetricNaming struct {
+	namespace string
+	labels    map[string]map[string]string
+}
+
+// NewMetricNaming returns the naming for namespace and the labels of devices.
+// With includeMAC set, every device also gets a mac label.
+func NewMetricNaming(namespace string, devices []Device, includeMAC bool) (*MetricNaming, error) {
+	if !namespaceRE.MatchString(namespace) {
+		return nil, fmt.Errorf("invalid metric namespace %q", namespace)
+	}
+
+	labels := make(map[string]map[string]string)
+	for _, d := range devices {
+		l := make(map[string]string, len(d.Labels)+1)
+		for name, value := range d.Labels {
+			l[name] = value
+		}
+		if _, ok := l["mac"]; includeMAC && !ok {
+			l["mac"] = strings.ToLower(d.Addr)
+		}
+		if len(l) > 0 {
+			labels[d.Name] = l
+		}
+	}
+	return &MetricNaming{
+		namespace: namespace,
+		labels:    labels,
+	}, nil
+}
+
+// MetricName returns name with the default namespace replaced
+func (n *MetricNaming) MetricName(name string) string {
+	rest, ok := strings.CutPrefix(name, defaultNamespace+"_")
+	if !ok || n.namespace == defaultNamespace {
+		return name
+	}
+	return n.namespace + "_" + rest
+}
+
+// DeviceLabels returns the custom labels of a device
+func (n *MetricNaming) DeviceLabels(location string) map[string]string {
+	return n.labels[location]
+}
+
+// Gatherer returns a Gatherer exporting the metrics of g with this naming
+func (n *MetricNaming) Gatherer(g prometheus.Gatherer) prometheus.Gatherer {
+	if n.namespace == defaultNamespace && len(n.labels) == 0 {
+		return g
+	}
+	return &relabelGatherer{
+		gatherer: g,
+		naming:   n,
+	}
+}
+
+// relabelGatherer renames the metric namespace and attaches the custom labels of each
+// device to every series carrying its location label
+type relabelGatherer struct {
+	gatherer prometheus.Gatherer
+	naming   *MetricNaming
+}
+
+// Gather implements prometheus.Gatherer
+func (r *relabelGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := r.gatherer.Gather()
+	for _, mf := range families {
+		name := r.naming.MetricName(mf.GetName())
+		mf.Name = &name
+
+		for _, m := range mf.Metric {
+			r.addLabels(m)
+		}
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+	return families, err
+}
+
+// addLabels attaches the custom labels of the device a metric belongs to.
+// Labels already set by the metric itself take precedence.
+func (r *relabelGatherer) addLabels(m *dto.Metric) {
+	var labels map[string]string
+	existing := make(map[string]bool, len(m.Label))
+	for _, lp := range m.Label {
+		existing[lp.GetName()] = true
+		if lp.GetName() == "location" {
+			labels = r.naming.DeviceLabels(lp.GetValue())
+		}
+	}
+	if len(labels) == 0 {
+		return
+	}
+
+	for name, value := range labels {
+		if existing[name] || value == "" {
+			continue
+		}
+		m.Label = append(m.Label, &dto.LabelPair{Name: &name, Value: &value})
+	}
+	sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+}
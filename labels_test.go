@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestValidLabelName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"room":     true,
+		"_floor":   true,
+		"location": false,
+		"le":       false,
+		"quantile": false,
+		"__name__": false,
+		"1st":      false,
+		"a-b":      false,
+	} {
+		if got := validLabelName(name); got != want {
+			t.Errorf("validLabelName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestNewMetricNamingNamespace(t *testing.T) {
+	for _, ns := range []string{"", "1x", "a-b"} {
+		if _, err := NewMetricNaming(ns, nil, false); err == nil {
+			t.Errorf("namespace %q accepted", ns)
+		}
+	}
+	n, err := NewMetricNaming("home", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := n.MetricName("mi_temperature_celsius"); got != "home_temperature_celsius" {
+		t.Errorf("MetricName = %q", got)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sync"
+
+	"github.com/currantlabs/ble"
+	"github.com/currantlabs/ble/linux/hci/cmd"
+	"github.com/currantlabs/ble/linux/hci/evt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Link quality measurements, published with the next reading of a device
+const (
+	MeasurementRSSI               = "rssi_dbm"
+	MeasurementConnInterval       = "connection_interval_seconds"
+	MeasurementConnLatency        = "connection_latency_events"
+	MeasurementSupervisionTimeout = "connection_supervision_timeout_seconds"
+)
+
+func init() {
+	RegisterSensorMetric(MeasurementRSSI, "MI sensor received signal strength of the last advertisement or connection")
+	RegisterSensorMetric(MeasurementConnInterval, "MI sensor connection interval negotiated by the controller")
+	RegisterSensorMetric(MeasurementConnLatency, "MI sensor connection events the peripheral may skip")
+	RegisterSensorMetric(MeasurementSupervisionTimeout, "MI sensor connection supervision timeout")
+}
+
+var connectionPHY = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "mi_connection_phy_info",
+	Help: "MI sensor connection PHY reported by the controller",
+},
+	[]string{"location", "tx", "rx"})
+
+// linkLayoutWarning logs once that connection parameters cannot be read from the BLE library
+var linkLayoutWarning sync.Once
+
+// phyNames maps LE PHY values to names
+var phyNames = map[uint8]string{1: "1M", 2: "2M", 3: "coded"}
+
+// leReadPHY implements LE Read PHY (0x08|0x0030), missing from the HCI command set
+type leReadPHY struct {
+	Handle uint16
+}
+
+// OpCode returns the opcode of the command
+func (c *leReadPHY) OpCode() int { return 0x08<<10 | 0x0030 }
+
+// Len returns the length of the command
+func (c *leReadPHY) Len() int { return 2 }
+
+// Marshal serializes the command parameters into binary form
+func (c *leReadPHY) Marshal(b []byte) error {
+	binary.LittleEndian.PutUint16(b, c.Handle)
+	return nil
+}
+
+// leReadPHYRP is the return parameter of LE Read PHY
+type leReadPHYRP struct {
+	Status           uint8
+	ConnectionHandle uint16
+	TxPHY            uint8
+	RxPHY            uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver
+func (c *leReadPHYRP) Unmarshal(b []byte) error {
+	if len(b) < 5 {
+		return fmt.Errorf("LE Read PHY response too short: %d bytes", len(b))
+	}
+	c.Status = b[0]
+	c.ConnectionHandle = binary.LittleEndian.Uint16(b[1:])
+	c.TxPHY, c.RxPHY = b[3], b[4]
+	return nil
+}
+
+// connectionComplete returns the LE Connection Complete event of a client connection.
+// The library keeps it unexported and offers no event hook, so it is read through reflection
+// of gatt.Client.conn and hci.Conn.param as laid out in github.com/currantlabs/ble
+// v0.0.0-20171229162446-c1d21c164cf8. TestConnectionComplete guards that layout, run it when
+// bumping the library. Any other layout reports no event instead of failing the session.
+func connectionComplete(c ble.Client) (e evt.LEConnectionComplete, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok = nil, false
+		}
+	}()
+
+	v := reflect.ValueOf(c)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil, false
+	}
+	conn := v.Elem().FieldByName("conn")
+	if !conn.IsValid() || conn.Kind() != reflect.Interface || conn.IsNil() {
+		return nil, false
+	}
+	hc := conn.Elem()
+	if hc.Kind() != reflect.Ptr || hc.Elem().Kind() != reflect.Struct {
+		return nil, false
+	}
+	param := hc.Elem().FieldByName("param")
+	if !param.IsValid() || param.Kind() != reflect.Slice || param.Type().Elem().Kind() != reflect.Uint8 {
+		return nil, false
+	}
+	e = evt.LEConnectionComplete(param.Bytes())
+	if len(e) < 19 {
+		return nil, false
+	}
+	return e, true
+}
+
+// readLinkQuality records the RSSI and parameters of the current connection in d.Link.
+// Values the controller does not report are skipped.
+func (d *Device) readLinkQuality() {
+	d.Link = make(map[string]float64)
+	e, ok := connectionComplete(d.Client)
+	if !ok {
+		linkLayoutWarning.Do(func() {
+			slog.Warn("Connection parameters unavailable, the BLE library layout may have changed", "device", d.Name)
+		})
+		// Without the connection handle only the client can report the RSSI, if it implements it
+		if rssi := d.Client.ReadRSSI(); rssi != 0 {
+			d.Link[MeasurementRSSI] = float64(rssi)
+		}
+		return
+	}
+
+	d.Link[MeasurementConnInterval] = float64(e.ConnInterval()) * 1.25 / 1000
+	d.Link[MeasurementConnLatency] = float64(e.ConnLatency())
+	d.Link[MeasurementSupervisionTimeout] = float64(e.SupervisionTimeout()) / 100
+
+	handle := e.ConnectionHandle()
+	var rp cmd.ReadRSSIRP
+	if err := bleDevice.HCI.Send(&cmd.ReadRSSI{Handle: handle}, &rp); err != nil {
+		slog.Debug("Unable to read connection RSSI",
+			"device", d.Name,
+			"error", err)
+	} else if rp.RSSI != 0 {
+		d.Link[MeasurementRSSI] = float64(rp.RSSI)
+	}
+
+	var phy leReadPHYRP
+	if err := bleDevice.HCI.Send(&leReadPHY{Handle: handle}, &phy); err != nil {
+		slog.Debug("Unable to read connection PHY",
+			"device", d.Name,
+			"error", err)
+	} else if tx, rx := phyNames[phy.TxPHY], phyNames[phy.RxPHY]; tx != "" && rx != "" {
+		connectionPHY.DeletePartialMatch(prometheus.Labels{"location": d.Name})
+		connectionPHY.WithLabelValues(d.Name, tx, rx).Set(1)
+	}
+
+	slog.Info("Connection link quality",
+		"device", d.Name,
+		"rssi", rp.RSSI,
+		"interval", float64(e.ConnInterval())*1.25,
+		"latency", e.ConnLatency(),
+		"supervisionTimeout", int(e.SupervisionTimeout())*10)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"unsafe"
+
+	"github.com/currantlabs/ble"
+	"github.com/currantlabs/ble/linux/gatt"
+	"github.com/currantlabs/ble/linux/hci"
+	"github.com/currantlabs/ble/linux/hci/evt"
+)
+
+// setField sets an unexported struct field, failing when the library no longer has it
+func setField(t *testing.T, ptr any, name string, value any) {
+	t.Helper()
+	f := reflect.ValueOf(ptr).Elem().FieldByName(name)
+	if !f.IsValid() {
+		t.Fatalf("%T has no field %s, connectionComplete needs updating", ptr, name)
+	}
+	v := reflect.ValueOf(value)
+	if !v.Type().AssignableTo(f.Type()) {
+		t.Fatalf("%T.%s is %s, connectionComplete needs updating", ptr, name, f.Type())
+	}
+	reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem().Set(v)
+}
+
+// TestConnectionComplete guards the unexported BLE library layout read by connectionComplete
+func TestConnectionComplete(t *testing.T) {
+	// Handle 0x0040, interval 24 (30 ms), latency 4, supervision timeout 500 (5 s)
+	param := evt.LEConnectionComplete{
+		0x01, 0x00, 0x40, 0x00, 0x00, 0x00,
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06,
+		0x18, 0x00, 0x04, 0x00, 0xf4, 0x01, 0x00,
+	}
+	conn := &hci.Conn{}
+	setField(t, conn, "param", param)
+	client := &gatt.Client{}
+	setField(t, client, "conn", ble.Conn(conn))
+
+	e, ok := connectionComplete(client)
+	if !ok {
+		t.Fatal("connectionComplete found no connection parameters")
+	}
+	if e.ConnectionHandle() != 0x40 || e.ConnInterval() != 24 || e.ConnLatency() != 4 || e.SupervisionTimeout() != 500 {
+		t.Errorf("unexpected parameters % x", []byte(e))
+	}
+
+	if _, ok := connectionComplete(&gatt.Client{}); ok {
+		t.Error("connectionComplete accepted a client without connection")
+	}
+}
+
+func TestReadLinkQualityUnknownLayout(t *testing.T) {
+	// A client the reflection does not understand keeps the session going with the client RSSI
+	d := &Device{Name: "unknown-layout", Client: &fakeClient{rssi: -71}}
+	d.readLinkQuality()
+	if want := map[string]float64{MeasurementRSSI: -71}; !reflect.DeepEqual(d.Link, want) {
+		t.Errorf("link = %v, want %v", d.Link, want)
+	}
+
+	d = &Device{Name: "unknown-layout", Client: &fakeClient{}}
+	d.readLinkQuality()
+	if len(d.Link) != 0 {
+		t.Errorf("link = %v, want none", d.Link)
+	}
+}
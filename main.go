@@ -16,13 +16,34 @@ import (
 
 const (
 	ver string = "0.17"
+
+	// defaultStateDir holds the files kept across restarts, mounted as a volume in the image
+	defaultStateDir = "/var/lib/gomijia2-exporter"
 )
 
 var (
-	configFile          = flag.String("config-file", "config.ini", "Config file location")
-	listenAddress       = flag.String("web.listen-address", ":8080", "Address to listen on for web interface and telemetry")
-	measurementInterval = flag.Int("measurement-interval", 60, "Measurement interval in seconds")
-	verbose             = flag.Bool("verbose", false, "Enable verbose output")
+	configFile            = flag.String("config-file", "config.ini", "Config file location")
+	listenAddress         = flag.String("web.listen-address", ":8080", "Address to listen on for web interface and telemetry")
+	measurementInterval   = flag.Int("measurement-interval", 60, "Measurement interval in seconds")
+	scanDuration          = flag.Int("scan-duration", 15, "Advertisement scan window in seconds for scan mode devices")
+	historyStateFile      = flag.String("history-state-file", defaultStateDir+"/history.json", "File to persist downloaded history records, empty keeps them in memory")
+	historyTimeout        = flag.Int("history-timeout", 30, "Maximum history download time per device in seconds")
+	clockMaxDrift         = flag.Int("clock-max-drift", 60, "Maximum device clock drift in seconds before the clock is synchronised")
+	staleAfter            = flag.Int("stale-after", 900, "Seconds without a reading after which a device is considered stale, 0 disables")
+	staleAction           = flag.String("stale-action", StaleActionFlag, "Action for stale devices: flag (set mi_up to 0) or drop (also remove their series)")
+	notificationTimeout   = flag.Int("notification-timeout", 6, "Maximum time in seconds to wait for sensor notifications after subscribing")
+	notificationSamples   = flag.Int("notification-samples", 1, "Notifications after which the wait ends early to release the BLE device sooner, 0 waits the full notification timeout")
+	notificationAggregate = flag.String("notification-aggregate", AggregateLast, "How notifications of one window are combined: last, mean or median")
+	metricsTimestamps     = flag.Bool("metrics-timestamps", false, "Export sensor samples with the time of the reading they come from")
+	metricsNamespace      = flag.String("metrics-namespace", defaultNamespace, "Prefix of the exported metric names, replacing mi")
+	metricsMACLabel       = flag.Bool("metrics-mac-label", false, "Attach the device MAC address as a mac label to every device series")
+	remoteWriteURL        = flag.String("remote-write-url", "", "Prometheus remote-write endpoint to push every reading to, empty disables")
+	remoteWriteQueueDir   = flag.String("remote-write-queue-dir", defaultStateDir+"/remote-write-queue", "Directory buffering readings until the remote-write endpoint accepts them")
+	remoteWriteBatchSize  = flag.Int("remote-write-batch-size", 100, "Maximum queued readings per remote-write request")
+	remoteWriteMaxQueue   = flag.Int("remote-write-max-queue", 100000, "Maximum queued readings, the oldest are dropped beyond it")
+	readyResetTimeout     = flag.Int("ready-reset-timeout", 300, "Seconds a BLE device reset may stay pending before /readyz fails")
+	readyReadingTimeout   = flag.Int("ready-reading-timeout", 900, "Seconds without a reading from any sensor before /readyz fails, 0 disables")
+	verbose               = flag.Bool("verbose", false, "Enable verbose output")
 )
 
 var (
@@ -31,6 +52,11 @@ var (
 		Help: "MI device errors",
 	},
 		[]string{"location"})
+	deviceStageErrorsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mi_device_stage_errors_total",
+		Help: "MI device errors by failure stage",
+	},
+		[]string{"location", "stage"})
 )
 
 // Global BLE device and mutex for synchronization
@@ -46,8 +72,13 @@ func resetBLEDevice() error {
 	resetBLEDeviceMutex.Lock()
 	defer resetBLEDeviceMutex.Unlock()
 
+	trigger := BLEDeviceResetTrigger()
+	if trigger == "" {
+		trigger = "unknown"
+	}
+
 	// Acquire the BLE device mutex to ensure no one is using it
-	slog.Warn("Starting BLE device reset process")
+	slog.Warn("Starting BLE device reset process", "trigger", trigger)
 	bleMutex.Lock()
 	defer bleMutex.Unlock()
 
@@ -66,6 +97,7 @@ func resetBLEDevice() error {
 		slog.Info("Stopping existing BLE device")
 		bleDevice.Stop()
 		bleDevice = nil
+		setAdapter(nil)
 	}
 
 	// Create new device
@@ -74,8 +106,11 @@ func resetBLEDevice() error {
 	bleDevice, err = linux.NewDevice()
 	if err != nil {
 		slog.Error("Failed to create new BLE device", "error", err)
+		recordReset(trigger, err)
 		return err
 	}
+	setAdapter(bleDevice)
+	recordReset(trigger, nil)
 
 	slog.Info("BLE device reset completed successfully")
 	ClearBLEDeviceResetRequest()
@@ -89,6 +124,11 @@ func main() {
 
 	flag.Parse()
 
+	// Docker HEALTHCHECK runs the binary itself, the image has no HTTP client
+	if flag.Arg(0) == "healthcheck" {
+		os.Exit(runHealthcheck(*listenAddress, flag.Arg(1)))
+	}
+
 	if *verbose {
 		loggingLevel.Set(slog.LevelDebug)
 		slog.Debug("Debug logging enabled")
@@ -96,6 +136,24 @@ func main() {
 
 	slog.Info("Starting", "version", ver)
 
+	if *staleAction != StaleActionFlag && *staleAction != StaleActionDrop {
+		slog.Error("Invalid stale action", "action", *staleAction)
+		os.Exit(1)
+	}
+
+	switch *notificationAggregate {
+	case AggregateLast, AggregateMean, AggregateMedian:
+	default:
+		slog.Error("Invalid notification aggregate", "aggregate", *notificationAggregate)
+		os.Exit(1)
+	}
+	if *notificationSamples < 0 || *notificationTimeout < 1 {
+		slog.Error("Notification samples must not be negative and timeout must be positive",
+			"samples", *notificationSamples,
+			"timeout", *notificationTimeout)
+		os.Exit(1)
+	}
+
 	slog.Info("Reading configuration")
 	config, err := NewConfig(*configFile)
 	if err != nil {
@@ -106,6 +164,26 @@ func main() {
 	// Store config globally for device reset
 	globalConfig = config
 
+	// Report every configured device before its first reading
+	for _, device := range config.Devices {
+		stateStore.Add(device.Name)
+		for _, stage := range errorStages {
+			deviceStageErrorsCounter.WithLabelValues(device.Name, stage)
+		}
+	}
+	prometheus.MustRegister(NewSensorCollector(stateStore, *metricsTimestamps))
+	naming, err := NewMetricNaming(*metricsNamespace, config.Devices, *metricsMACLabel)
+	if err != nil {
+		slog.Error("Invalid metric naming", "error", err)
+		os.Exit(1)
+	}
+
+	historyStore, err = NewHistoryStore(*historyStateFile)
+	if err != nil {
+		slog.Error("Unable to load history state", "error", err)
+		os.Exit(1)
+	}
+
 	// Create the BLE device once for all handlers to share
 	slog.Info("Starting Linux Device")
 	bleDevice, err = linux.NewDevice()
@@ -113,6 +191,7 @@ func main() {
 		slog.Error("Failed to initialize BLE device", "error", err)
 		os.Exit(1)
 	}
+	setAdapter(bleDevice)
 
 	// Start a goroutine to monitor and reset BLE device if needed
 	go func() {
@@ -120,6 +199,8 @@ func main() {
 		checkCount := 0
 
 		for {
+			resetMonitorTick()
+
 			// Log the monitor status periodically
 			checkCount++
 			if checkCount%4 == 0 { // Log every minute
@@ -142,8 +223,54 @@ func main() {
 		}
 	}()
 
+	// Push readings when Prometheus cannot scrape the exporter
+	if *remoteWriteURL != "" {
+		queue, err := NewDiskQueue(*remoteWriteQueueDir, *remoteWriteMaxQueue)
+		if err != nil {
+			slog.Error("Unable to open remote-write queue", "error", err)
+			os.Exit(1)
+		}
+		writer := NewRemoteWriter(*remoteWriteURL, queue, naming, *remoteWriteBatchSize)
+		stateStore.Listen(writer.Enqueue)
+		slog.Info("Starting remote write", "url", *remoteWriteURL, "queueDir", *remoteWriteQueueDir)
+		go writer.Run()
+	}
+
+	stateStore.Listen(recordReading)
+
+	// Live stream of readings and device state changes
+	stateStore.Listen(streamHub.PublishReading)
+	stateStore.ListenUp(streamHub.PublishUp)
+
+	if config.MQTT != nil {
+		publisher, err := NewMQTTPublisher(config.MQTT, config.Devices)
+		if err != nil {
+			slog.Error("Unable to set up MQTT output", "error", err)
+			os.Exit(1)
+		}
+		stateStore.Listen(publisher.Publish)
+		stateStore.ListenUp(publisher.SetAvailability)
+	}
+
+	if config.InfluxDB != nil {
+		writer := NewInfluxWriter(config.InfluxDB, naming)
+		stateStore.Listen(writer.Write)
+		go writer.Run()
+	}
+
+	if *staleAfter > 0 {
+		go monitorStaleness(config.Devices, time.Duration(*staleAfter)*time.Second, *staleAction)
+	}
+
+	// Readers start last so that every output listens before the first reading reaches the store.
 	// Start handlers for each device with staggered timing
+	scanDevices := []Device{}
 	for i, device := range config.Devices {
+		if device.Mode == ModeScan {
+			scanDevices = append(scanDevices, device)
+			continue
+		}
+
 		slog.Info("Starting handler for device",
 			"device", device.Name,
 			"address", device.Addr)
@@ -156,8 +283,25 @@ func main() {
 		}(device, startDelay)
 	}
 
+	// Scan mode devices share a single passive scanner
+	if len(scanDevices) > 0 {
+		slog.Info("Starting advertisement scanner", "devices", len(scanDevices))
+		go RegisterScanner(scanDevices)
+	}
+
 	slog.Info("Starting HTTP server", "address", *listenAddress)
-	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/metrics", promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(naming.Gatherer(prometheus.DefaultGatherer), promhttp.HandlerOpts{}),
+	))
+	http.HandleFunc("GET /{$}", statusHandler)
+	http.HandleFunc("GET /healthz", healthzHandler)
+	http.HandleFunc("GET /readyz", readyzHandler)
+	http.HandleFunc("/history", historyHandler)
+	http.HandleFunc("GET /api/devices", devicesHandler)
+	http.HandleFunc("GET /api/devices/{name}", deviceHandler)
+	http.HandleFunc("GET /api/stream", streamHandler)
+	http.Handle("GET /api/stream/ws", streamWebSocketHandler)
 	err = http.ListenAndServe(*listenAddress, nil)
 	if err != nil {
 		slog.Error("HTTP server error", "error", err)
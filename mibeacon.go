@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/currantlabs/ble"
+)
+
+var (
+	// Xiaomi MiBeacon service data UUID
+	miBeaconUUID = ble.UUID16(0xfe95)
+)
+
+// MiBeacon frame control bits
+const (
+	miBeaconEncrypted         = 0x0008
+	miBeaconMACInclude        = 0x0010
+	miBeaconCapabilityInclude = 0x0020
+	miBeaconObjectInclude     = 0x0040
+)
+
+// MiBeacon represents a decoded MiBeacon frame
+type MiBeacon struct {
+	Version   int
+	ProductID uint16
+	Counter   uint32
+	Encrypted bool
+	Values    map[string]float64
+}
+
+// UnmarshallMiBeacon converts MiBeacon service data into a MiBeacon.
+// Encrypted v4/v5 frames require the device bindkey and MAC address.
+func UnmarshallMiBeacon(req []byte, addr string, bindkey []byte) (*MiBeacon, error) {
+	// 00 01 02 03 04 05-10 11 ...
+	// FC FC P1 P2 CN MAC   CP OBJECTS
+	l := len(req)
+	if l < 5 {
+		return &MiBeacon{}, fmt.Errorf("Expecting at least 5 bytes got %d", l)
+	}
+
+	frctrl := binary.LittleEndian.Uint16(req[0:2])
+	b := &MiBeacon{
+		Version:   int(frctrl >> 12),
+		ProductID: binary.LittleEndian.Uint16(req[2:4]),
+		Counter:   uint32(req[4]),
+		Encrypted: frctrl&miBeaconEncrypted != 0,
+		Values:    make(map[string]float64),
+	}
+
+	i := 5
+	var mac []byte
+	if frctrl&miBeaconMACInclude != 0 {
+		if l < i+6 {
+			return b, fmt.Errorf("Truncated MAC address in %d bytes", l)
+		}
+		mac = req[i : i+6]
+		i += 6
+	}
+	if frctrl&miBeaconCapabilityInclude != 0 {
+		if l < i+1 {
+			return b, fmt.Errorf("Truncated capability in %d bytes", l)
+		}
+		capability := req[i]
+		i++
+		// I/O capability follows when bit 5 of the capability is set
+		if capability&0x20 != 0 {
+			i += 2
+		}
+	}
+	if frctrl&miBeaconObjectInclude == 0 || i >= l {
+		return b, nil
+	}
+
+	payload := req[i:]
+	if b.Encrypted {
+		if b.Version < 4 {
+			return b, fmt.Errorf("Unsupported encrypted MiBeacon version %d", b.Version)
+		}
+		if len(bindkey) == 0 {
+			return b, fmt.Errorf("Encrypted MiBeacon frame requires a bindkey")
+		}
+		// Payload is followed by a 3 byte extended counter and a 4 byte MIC
+		if len(payload) < 8 {
+			return b, fmt.Errorf("Truncated encrypted payload of %d bytes", len(payload))
+		}
+		if mac == nil {
+			hw, err := parseMAC(addr)
+			if err != nil {
+				return b, err
+			}
+			// Frames carry the MAC address in reversed byte order
+			mac = []byte{hw[5], hw[4], hw[3], hw[2], hw[1], hw[0]}
+		}
+
+		ext := req[l-7 : l-4]
+		nonce := make([]byte, 0, 12)
+		nonce = append(nonce, mac...)
+		nonce = append(nonce, req[2:5]...)
+		nonce = append(nonce, ext...)
+
+		var err error
+		payload, err = ccmOpen(bindkey, nonce, payload[:len(payload)-7], req[l-4:], []byte{0x11})
+		if err != nil {
+			return b, err
+		}
+		b.Counter = uint32(ext[2])<<24 | uint32(ext[1])<<16 | uint32(ext[0])<<8 | uint32(req[4])
+	}
+
+	return b, b.parseObjects(payload)
+}
+
+// parseObjects decodes the type-length-value objects of a MiBeacon payload
+func (b *MiBeacon) parseObjects(payload []byte) error {
+	for len(payload) >= 3 {
+		typ := binary.LittleEndian.Uint16(payload[0:2])
+		n := int(payload[2])
+		if len(payload) < 3+n {
+			return fmt.Errorf("Truncated object 0x%04x", typ)
+		}
+		obj := payload[3 : 3+n]
+		payload = payload[3+n:]
+
+		switch {
+		case typ == 0x1004 && n == 2:
+			b.Values["temperature"] = float64(int16(binary.LittleEndian.Uint16(obj))) / 10
+		case typ == 0x1006 && n == 2:
+			b.Values["humidity"] = float64(binary.LittleEndian.Uint16(obj)) / 10
+		case typ == 0x1007 && n == 3:
+			b.Values["illuminance"] = float64(uint32(obj[0]) | uint32(obj[1])<<8 | uint32(obj[2])<<16)
+		case typ == 0x1008 && n == 1:
+			b.Values["moisture"] = float64(obj[0])
+		case typ == 0x1009 && n == 2:
+			b.Values["conductivity"] = float64(binary.LittleEndian.Uint16(obj))
+		case typ == 0x100a && n >= 1:
+			b.Values["battery"] = float64(obj[0])
+		case typ == 0x100d && n == 4:
+			b.Values["temperature"] = float64(int16(binary.LittleEndian.Uint16(obj[0:2]))) / 10
+			b.Values["humidity"] = float64(binary.LittleEndian.Uint16(obj[2:4])) / 10
+		case typ == 0x1010 && n == 2:
+			b.Values["formaldehyde"] = float64(binary.LittleEndian.Uint16(obj)) / 100
+		case typ == 0x4803 && n == 1:
+			b.Values["battery"] = float64(obj[0])
+		case typ == 0x4c01 && n == 4:
+			b.Values["temperature"] = math.Round(float64(math.Float32frombits(binary.LittleEndian.Uint32(obj)))*100) / 100
+		case typ == 0x4c02 && n == 1:
+			b.Values["humidity"] = float64(obj[0])
+		case typ == 0x4c08 && n == 4:
+			b.Values["humidity"] = math.Round(float64(math.Float32frombits(binary.LittleEndian.Uint32(obj)))*100) / 100
+		}
+	}
+	return nil
+}
+
+// A counter that went backwards is only a restart candidate when it is near zero, where a
+// rebooted device starts counting, or further behind the last counter than replayWindow.
+// Counters within the window are replays of recent frames and always rejected.
+// A candidate is accepted after replayReseedRejects distinct increasing candidates in a row,
+// or when nothing was accepted from the device for replayReseedAfter.
+const (
+	replayWindow        = 64
+	replayReseedRejects = 3
+	replayReseedAfter   = 10 * time.Minute
+)
+
+// frameCounters rejects replayed or duplicated frames per device
+type frameCounters struct {
+	mu       sync.Mutex
+	last     map[string]uint32
+	accepted map[string]time.Time
+	rejects  map[string]int
+	rejected map[string]uint32
+}
+
+// newFrameCounters returns an empty frameCounters
+func newFrameCounters() *frameCounters {
+	return &frameCounters{
+		last:     make(map[string]uint32),
+		accepted: make(map[string]time.Time),
+		rejects:  make(map[string]int),
+		rejected: make(map[string]uint32),
+	}
+}
+
+// accept reports whether counter is newer than the last accepted counter of the device.
+// Counters of the given bit width wrap around, so serial number arithmetic is used.
+// A counter that keeps going backwards outside the replay window is taken as a device restart
+// and reseeds the device.
+func (f *frameCounters) accept(name string, counter uint32, bits uint) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	last, ok := f.last[name]
+	if ok {
+		mask := uint32(1)<<bits - 1
+		if bits >= 32 {
+			mask = math.MaxUint32
+		}
+		diff := (counter - last) & mask
+		if diff == 0 {
+			return false
+		}
+		if diff > mask/2 {
+			if back := (last - counter) & mask; counter >= replayWindow && back <= replayWindow {
+				return false
+			}
+			// Advertisements repeat each frame, so only new, increasing counters count towards a restart
+			switch {
+			case f.rejects[name] == 0:
+				f.rejects[name] = 1
+			case f.rejected[name] == counter:
+			case (counter-f.rejected[name])&mask <= mask/2:
+				f.rejects[name]++
+			default:
+				f.rejects[name] = 1
+			}
+			f.rejected[name] = counter
+			if f.rejects[name] < replayReseedRejects && time.Since(f.accepted[name]) < replayReseedAfter {
+				return false
+			}
+			slog.Warn("Frame counter went backwards, assuming the device restarted",
+				"device", name,
+				"last", last,
+				"counter", counter)
+		}
+	}
+	f.last[name] = counter
+	f.accepted[name] = time.Now()
+	f.rejects[name] = 0
+	return true
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUnmarshallMiBeacon(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		addr    string
+		bindkey string
+		counter uint32
+		values  map[string]float64
+	}{
+		{
+			// Published xiaomi-ble vector of a YLYK01YL remote button press
+			name:    "v5 encrypted published",
+			data:    "5859970964bc9ce344ef5422206088fd000000003a148fb3",
+			addr:    "54:EF:44:E3:9C:BC",
+			bindkey: "5b51a7c91cde6707c9ef18dfda143a58",
+			counter: 0x64,
+			values:  map[string]float64{},
+		},
+		{
+			// Sealed with OpenSSL AES-CCM, the MAC address comes from the device address
+			name:    "v4 encrypted without MAC",
+			data:    "48485b052a5bf066745b2d480100000335f4b3",
+			addr:    "A4:C1:38:83:F4:50",
+			bindkey: "e9ea895fac7cca6d30532432a516f3a8",
+			counter: 0x0000012a,
+			values:  map[string]float64{"temperature": 23.3, "humidity": 55.5},
+		},
+		{
+			// Sealed with OpenSSL AES-CCM
+			name:    "v5 encrypted with MAC",
+			data:    "58585b050750f48338c1a407b97379ca426fad6e0200009091c480",
+			addr:    "A4:C1:38:83:F4:50",
+			bindkey: "e9ea895fac7cca6d30532432a516f3a8",
+			counter: 0x00000207,
+			values:  map[string]float64{"temperature": -5, "battery": 87},
+		},
+		{
+			name:    "plain temperature and humidity",
+			data:    "5020aa01da50f48338c1a40d1004e9002b02",
+			addr:    "A4:C1:38:83:F4:50",
+			counter: 0xda,
+			values:  map[string]float64{"temperature": 23.3, "humidity": 55.5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var key []byte
+			if tt.bindkey != "" {
+				key = unhex(t, tt.bindkey)
+			}
+			b, err := UnmarshallMiBeacon(unhex(t, tt.data), tt.addr, key)
+			if err != nil {
+				t.Fatalf("UnmarshallMiBeacon: %v", err)
+			}
+			if b.Counter != tt.counter {
+				t.Errorf("counter = %#x, want %#x", b.Counter, tt.counter)
+			}
+			if !reflect.DeepEqual(b.Values, tt.values) {
+				t.Errorf("values = %v, want %v", b.Values, tt.values)
+			}
+		})
+	}
+}
+
+func TestUnmarshallMiBeaconWrongKey(t *testing.T) {
+	data := unhex(t, "5859970964bc9ce344ef5422206088fd000000003a148fb3")
+	if _, err := UnmarshallMiBeacon(data, "54:EF:44:E3:9C:BC", make([]byte, 16)); err == nil {
+		t.Error("UnmarshallMiBeacon decrypted a frame with the wrong bindkey")
+	}
+	if _, err := UnmarshallMiBeacon(data, "54:EF:44:E3:9C:BC", nil); err == nil {
+		t.Error("UnmarshallMiBeacon accepted an encrypted frame without bindkey")
+	}
+}
+
+func TestFrameCountersReplay(t *testing.T) {
+	f := newFrameCounters()
+	for _, c := range []uint32{10, 11, 200} {
+		if !f.accept("d", c, 32) {
+			t.Errorf("counter %d rejected", c)
+		}
+	}
+	if f.accept("d", 200, 32) {
+		t.Error("duplicate counter accepted")
+	}
+	if f.accept("d", 11, 32) {
+		t.Error("older counter accepted")
+	}
+	if !f.accept("w", 250, 8) || !f.accept("w", 3, 8) {
+		t.Error("wrapped 8 bit counter rejected")
+	}
+}
+
+func TestFrameCountersRestart(t *testing.T) {
+	f := newFrameCounters()
+	f.accept("d", 50000, 32)
+
+	// A rebooted device counts from zero again, duplicates do not count towards the restart
+	for i := uint32(0); i < replayReseedRejects-1; i++ {
+		if f.accept("d", i, 32) || f.accept("d", i, 32) {
+			t.Fatalf("counter %d accepted before the restart was detected", i)
+		}
+	}
+	if !f.accept("d", replayReseedRejects, 32) {
+		t.Fatal("restarted device still rejected")
+	}
+	if !f.accept("d", replayReseedRejects+1, 32) {
+		t.Error("counter after reseed rejected")
+	}
+
+	// After a long silence the first frame is accepted even if older
+	f.accepted["d"] = time.Now().Add(-replayReseedAfter)
+	if !f.accept("d", 1, 32) {
+		t.Error("counter after a long gap rejected")
+	}
+}
+
+func TestFrameCountersReplayNotReseeded(t *testing.T) {
+	f := newFrameCounters()
+	f.accept("d", 5000, 32)
+
+	// Replays of recent frames never count as a restart, not even after a long silence
+	for _, c := range []uint32{4990, 4995, 4998, 4999} {
+		if f.accept("d", c, 32) {
+			t.Errorf("recent counter %d accepted", c)
+		}
+	}
+	f.accepted["d"] = time.Now().Add(-replayReseedAfter)
+	if f.accept("d", 4999, 32) {
+		t.Error("recent counter accepted after a long gap")
+	}
+
+	// Old frames replayed out of order do not add up to a restart
+	f.accepted["d"] = time.Now()
+	for _, c := range []uint32{3000, 2000, 1000} {
+		if f.accept("d", c, 32) {
+			t.Errorf("old counter %d accepted", c)
+		}
+	}
+
+	// A device far behind that keeps counting up is a restart
+	if f.accept("d", 1001, 32) {
+		t.Error("counter 1001 accepted before the restart was detected")
+	}
+	if !f.accept("d", 1002, 32) {
+		t.Error("increasing counters far behind not taken as a restart")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/currantlabs/ble"
+)
+
+// DefaultModel is used for devices without a configured model
+const DefaultModel = "LYWSD03MMC"
+
+var (
+	// Client Characteristic Configuration descriptor
+	cccdUUID = ble.MustParse("00002902-0000-1000-8000-00805f9b34fb")
+
+	// Xiaomi temperature and humidity service and its data characteristic
+	xiaomiDataServiceUUID = ble.MustParse("ebe0ccb0-7a0a-4b0c-8a1a-6ff2997da3a6")
+	xiaomiDataUUID        = ble.MustParse("ebe0ccc1-7a0a-4b0c-8a1a-6ff2997da3a6")
+
+	models      = make(map[string]*Model)
+	modelsMutex sync.RWMutex
+)
+
+// Model describes how to read a sensor model over GATT
+type Model struct {
+	// Name is the model key used in the config file
+	Name string
+	// Service contains the notification characteristic
+	Service ble.UUID
+	// Characteristic notifies the sensor payload
+	Characteristic ble.UUID
+	// Enable is written with EnableValue to trigger notifications
+	Enable      ble.UUID
+	EnableValue []byte
+	// Decode converts a notification payload into a Reading
+	Decode func([]byte) (*Reading, error)
+	// Metrics lists the Reading measurements the model provides
+	Metrics []string
+	// History notifies stored records after their start index is written to HistoryIndex.
+	// Models without on-device history leave it nil.
+	History       ble.UUID
+	HistoryIndex  ble.UUID
+	DecodeHistory func([]byte) (*HistoryRecord, error)
+	// Settings lists the device settings the stock firmware accepts by config key
+	Settings map[string]*Setting
+	// BatteryCurve names the default discharge curve of the model's battery
+	BatteryCurve string
+}
+
+// Supports reports whether the model provides a measurement
+func (m *Model) Supports(measurement string) bool {
+	for _, metric := range m.Metrics {
+		if metric == measurement {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterModel adds a sensor model to the registry
+func RegisterModel(m *Model) {
+	modelsMutex.Lock()
+	defer modelsMutex.Unlock()
+
+	key := strings.ToUpper(m.Name)
+	if _, ok := models[key]; ok {
+		panic("duplicate sensor model " + m.Name)
+	}
+	models[key] = m
+}
+
+// LookupModel returns the registered sensor model with the given name
+func LookupModel(name string) (*Model, error) {
+	modelsMutex.RLock()
+	defer modelsMutex.RUnlock()
+
+	if m, ok := models[strings.ToUpper(name)]; ok {
+		return m, nil
+	}
+
+	names := make([]string, 0, len(models))
+	for _, m := range models {
+		names = append(names, m.Name)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown sensor model %q, supported models: %s", name, strings.Join(names, ", "))
+}
+
+// findCharacteristic looks up a characteristic within a service of the profile
+func findCharacteristic(p *ble.Profile, service, characteristic ble.UUID) *ble.Characteristic {
+	for _, s := range p.Services {
+		if service != nil && !s.UUID.Equal(service) {
+			continue
+		}
+		for _, c := range s.Characteristics {
+			if c.UUID.Equal(characteristic) {
+				return c
+			}
+		}
+	}
+
+	if service != nil {
+		slog.Debug("Characteristic not found in service, searching whole profile",
+			"service", service.String(),
+			"uuid", characteristic.String())
+		return findCharacteristic(p, nil, characteristic)
+	}
+	return nil
+}
+
+func init() {
+	RegisterModel(&Model{
+		Name:           "LYWSD03MMC",
+		Service:        xiaomiDataServiceUUID,
+		Characteristic: xiaomiDataUUID,
+		Enable:         cccdUUID,
+		EnableValue:    []byte{0x01, 0x00},
+		Decode:         Unmarshall,
+		Metrics:        []string{"temperature", "humidity", "voltage", "battery"},
+		History:        xiaomiHistoryUUID,
+		HistoryIndex:   xiaomiHistoryIndexUUID,
+		DecodeHistory:  UnmarshallHistory,
+		Settings:       stockSettings,
+		BatteryCurve:   "CR2032",
+	})
+	RegisterModel(&Model{
+		Name:           "MHO-C401",
+		Service:        xiaomiDataServiceUUID,
+		Characteristic: xiaomiDataUUID,
+		Enable:         cccdUUID,
+		EnableValue:    []byte{0x01, 0x00},
+		Decode:         Unmarshall,
+		Metrics:        []string{"temperature", "humidity", "voltage", "battery"},
+		History:        xiaomiHistoryUUID,
+		HistoryIndex:   xiaomiHistoryIndexUUID,
+		DecodeHistory:  UnmarshallHistory,
+		Settings:       stockSettings,
+		BatteryCurve:   "CR2032",
+	})
+	RegisterModel(&Model{
+		Name:           "LYWSD02",
+		Service:        xiaomiDataServiceUUID,
+		Characteristic: xiaomiDataUUID,
+		Enable:         cccdUUID,
+		EnableValue:    []byte{0x01, 0x00},
+		Decode:         UnmarshallLYWSD02,
+		Metrics:        []string{"temperature", "humidity"},
+		History:        xiaomiHistoryUUID,
+		HistoryIndex:   xiaomiHistoryIndexUUID,
+		DecodeHistory:  UnmarshallHistory,
+		Settings:       lywsd02Settings,
+		BatteryCurve:   "CR2032",
+	})
+}
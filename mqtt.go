@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/ini.v1"
+)
+
+// MQTT availability payloads
+const (
+	mqttOnline  = "online"
+	mqttOffline = "offline"
+)
+
+// MQTTConfig holds the MQTT output settings from the MQTT config section
+type MQTTConfig struct {
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	QoS      byte
+	Retain   bool
+
+	// TopicPrefix is the base of the state and availability topics
+	TopicPrefix string
+	// DiscoveryPrefix is the Home Assistant discovery prefix, empty disables discovery
+	DiscoveryPrefix string
+
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+// parseMQTTConfig reads the MQTT section
+func parseMQTTConfig(s *ini.Section) (*MQTTConfig, error) {
+	c := &MQTTConfig{
+		Broker:             s.Key("broker").String(),
+		ClientID:           s.Key("client_id").MustString("gomijia2-exporter"),
+		Username:           s.Key("username").String(),
+		Password:           s.Key("password").String(),
+		Retain:             s.Key("retain").MustBool(false),
+		TopicPrefix:        strings.TrimSuffix(s.Key("topic_prefix").MustString("gomijia2"), "/"),
+		DiscoveryPrefix:    strings.TrimSuffix(s.Key("discovery_prefix").MustString("homeassistant"), "/"),
+		CAFile:             s.Key("ca_file").String(),
+		CertFile:           s.Key("cert_file").String(),
+		KeyFile:            s.Key("key_file").String(),
+		InsecureSkipVerify: s.Key("insecure_skip_verify").MustBool(false),
+	}
+	if c.Broker == "" {
+		return nil, fmt.Errorf("mqtt: broker is required")
+	}
+	if f := s.Key("password_file").String(); f != "" {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt: %w", err)
+		}
+		c.Password = strings.TrimSpace(string(b))
+	}
+	qos := s.Key("qos").MustInt(0)
+	if qos < 0 || qos > 2 {
+		return nil, fmt.Errorf("mqtt: qos must be 0, 1 or 2, got %d", qos)
+	}
+	c.QoS = byte(qos)
+	if !s.Key("discovery").MustBool(true) {
+		c.DiscoveryPrefix = ""
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, fmt.Errorf("mqtt: cert_file and key_file must be set together")
+	}
+	return c, nil
+}
+
+// tlsConfig returns the TLS settings, nil when none are configured
+func (c *MQTTConfig) tlsConfig() (*tls.Config, error) {
+	if c.CAFile == "" && c.CertFile == "" && !c.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	t := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		t.RootCAs = x509.NewCertPool()
+		if !t.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+	return t, nil
+}
+
+// haSensor describes how a measurement appears in Home Assistant
+type haSensor struct {
+	Name        string
+	Unit        string
+	DeviceClass string
+}
+
+// haSensors maps measurements to Home Assistant sensor settings
+var haSensors = map[string]haSensor{
+	"temperature":             {"Temperature", "°C", "temperature"},
+	"humidity":                {"Humidity", "%", "humidity"},
+	"voltage":                 {"Battery voltage", "V", "voltage"},
+	"battery":                 {"Battery", "%", "battery"},
+	"illuminance":             {"Illuminance", "lx", "illuminance"},
+	"moisture":                {"Moisture", "%", "moisture"},
+	"conductivity":            {"Conductivity", "µS/cm", ""},
+	"formaldehyde":            {"Formaldehyde", "mg/m³", ""},
+	"dew_point":               {"Dew point", "°C", "temperature"},
+	"absolute_humidity":       {"Absolute humidity", "g/m³", "absolute_humidity"},
+	"heat_index":              {"Heat index", "°C", "temperature"},
+	"vapour_pressure_deficit": {"Vapour pressure deficit", "kPa", "pressure"},
+	MeasurementRSSI:           {"Signal strength", "dBm", "signal_strength"},
+}
+
+// MQTTPublisher publishes readings, availability and Home Assistant discovery to an MQTT broker
+type MQTTPublisher struct {
+	config  *MQTTConfig
+	client  mqtt.Client
+	devices map[string]Device
+
+	mu        sync.Mutex
+	announced map[string]bool
+}
+
+// NewMQTTPublisher connects to the broker in the background and returns the publisher
+func NewMQTTPublisher(config *MQTTConfig, devices []Device) (*MQTTPublisher, error) {
+	p := &MQTTPublisher{
+		config:    config,
+		devices:   make(map[string]Device),
+		announced: make(map[string]bool),
+	}
+	for _, d := range devices {
+		p.devices[d.Name] = d
+	}
+
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: %w", err)
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetTLSConfig(tlsConfig).
+		SetWill(p.bridgeTopic(), mqttOffline, config.QoS, true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOrderMatters(false).
+		SetOnConnectHandler(p.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("MQTT connection lost", "error", err)
+		})
+	p.client = mqtt.NewClient(opts)
+	p.client.Connect()
+	return p, nil
+}
+
+// mqttTopicEscape replaces the topic separator and wildcards, which are not allowed in a topic level
+var mqttTopicEscape = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// topicLevel returns a device name usable as a single topic level
+func topicLevel(name string) string {
+	return mqttTopicEscape.Replace(name)
+}
+
+// bridgeTopic is the availability topic of the exporter itself, cleared by the LWT
+func (p *MQTTPublisher) bridgeTopic() string {
+	return p.config.TopicPrefix + "/status"
+}
+
+// stateTopic carries the JSON readings of a device
+func (p *MQTTPublisher) stateTopic(name string) string {
+	return p.config.TopicPrefix + "/" + topicLevel(name) + "/state"
+}
+
+// availabilityTopic follows the staleness of a device
+func (p *MQTTPublisher) availabilityTopic(name string) string {
+	return p.config.TopicPrefix + "/" + topicLevel(name) + "/availability"
+}
+
+// onConnect announces the exporter and republishes discovery and availability after each (re)connect
+func (p *MQTTPublisher) onConnect(mqtt.Client) {
+	slog.Info("Connected to MQTT broker", "broker", p.config.Broker)
+	p.publish(p.bridgeTopic(), mqttOnline, true)
+
+	p.mu.Lock()
+	p.announced = make(map[string]bool)
+	p.mu.Unlock()
+
+	for _, s := range stateStore.Snapshot() {
+		measurements := make([]string, 0, len(s.Samples))
+		for m := range s.Samples {
+			measurements = append(measurements, m)
+		}
+		p.announce(s.Name, measurements)
+		p.SetAvailability(s.Name, s.Up)
+	}
+}
+
+// publish sends a payload without blocking the caller, logging failures
+func (p *MQTTPublisher) publish(topic string, payload any, retained bool) {
+	token := p.client.Publish(topic, p.config.QoS, retained, payload)
+	go func() {
+		if token.WaitTimeout(30*time.Second) && token.Error() != nil {
+			slog.Error("MQTT publish failed",
+				"topic", topic,
+				"error", token.Error())
+		}
+	}()
+}
+
+// announce publishes Home Assistant discovery for measurements not yet announced
+func (p *MQTTPublisher) announce(name string, measurements []string) {
+	if p.config.DiscoveryPrefix == "" {
+		return
+	}
+	d := p.devices[name]
+	id := strings.ReplaceAll(strings.ToLower(d.Addr), ":", "")
+	if id == "" {
+		id = topicLevel(name)
+	}
+	model := ""
+	if d.Model != nil {
+		model = d.Model.Name
+	}
+
+	for _, m := range measurements {
+		sensor, ok := haSensors[m]
+		key := name + "/" + m
+		p.mu.Lock()
+		done := p.announced[key]
+		p.announced[key] = true
+		p.mu.Unlock()
+		if !ok || done {
+			continue
+		}
+
+		config := map[string]any{
+			"name":                sensor.Name,
+			"unique_id":           "gomijia2_" + id + "_" + m,
+			"object_id":           topicLevel(name) + "_" + m,
+			"state_topic":         p.stateTopic(name),
+			"value_template":      "{{ value_json." + m + " }}",
+			"unit_of_measurement": sensor.Unit,
+			"state_class":         "measurement",
+			"availability": []map[string]string{
+				{"topic": p.bridgeTopic()},
+				{"topic": p.availabilityTopic(name)},
+			},
+			"availability_mode": "all",
+			"device": map[string]any{
+				"identifiers":  []string{"gomijia2_" + id},
+				"connections":  [][]string{{"mac", strings.ToLower(d.Addr)}},
+				"name":         name,
+				"manufacturer": "Xiaomi",
+				"model":        model,
+			},
+		}
+		if sensor.DeviceClass != "" {
+			config["device_class"] = sensor.DeviceClass
+		}
+		if m == "voltage" || m == "battery" || m == MeasurementRSSI {
+			config["entity_category"] = "diagnostic"
+		}
+		payload, err := json.Marshal(config)
+		if err != nil {
+			slog.Error("Unable to encode MQTT discovery", "device", name, "error", err)
+			continue
+		}
+		p.publish(fmt.Sprintf("%s/sensor/gomijia2_%s/%s/config", p.config.DiscoveryPrefix, id, m), payload, true)
+	}
+}
+
+// Publish sends the latest value of every measurement of a device after a reading.
+// Readings may carry only some measurements, so the retained state is built from the
+// whole StateStore entry instead of the reading alone. It is a StateStore Listener.
+func (p *MQTTPublisher) Publish(name string, values map[string]float64, t time.Time) {
+	if !p.client.IsConnectionOpen() {
+		slog.Debug("MQTT not connected, skipping reading", "device", name)
+		return
+	}
+	snapshot, ok := stateStore.Get(name)
+	if !ok {
+		return
+	}
+
+	state := make(map[string]any, len(snapshot.Samples)+1)
+	measurements := make([]string, 0, len(snapshot.Samples))
+	for m, s := range snapshot.Samples {
+		state[m] = s.Value
+		measurements = append(measurements, m)
+	}
+	state["timestamp"] = snapshot.Updated.UTC().Format(time.RFC3339)
+	payload, err := json.Marshal(state)
+	if err != nil {
+		slog.Error("Unable to encode MQTT state", "device", name, "error", err)
+		return
+	}
+
+	p.announce(name, measurements)
+	p.publish(p.stateTopic(name), payload, p.config.Retain)
+}
+
+// SetAvailability publishes whether a device is up. It is a StateStore UpListener.
+func (p *MQTTPublisher) SetAvailability(name string, up bool) {
+	payload := mqttOffline
+	if up {
+		payload = mqttOnline
+	}
+	p.publish(p.availabilityTopic(name), payload, true)
+}
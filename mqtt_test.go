@@ -0,0 +1,13 @@
+package main
+
+import "testing"
+
+func TestMQTTTopics(t *testing.T) {
+	p := &MQTTPublisher{config: &MQTTConfig{TopicPrefix: "gomijia2"}}
+	if got, want := p.stateTopic("living/room+#1"), "gomijia2/living_room__1/state"; got != want {
+		t.Errorf("stateTopic = %q, want %q", got, want)
+	}
+	if got, want := p.availabilityTopic("kitchen"), "gomijia2/kitchen/availability"; got != want {
+		t.Errorf("availabilityTopic = %q, want %q", got, want)
+	}
+}
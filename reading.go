@@ -39,3 +39,58 @@ func Unmarshall(req []byte) (*Reading, error) {
 		Voltage:     v,
 	}, nil
 }
+
+// UnmarshallATC converts an ATC1441 custom firmware advertisement into a Reading
+func UnmarshallATC(req []byte) (*Reading, error) {
+	// 00-05 06 07 08 09 10 11 12
+	// MAC   T2 T1 HX B% V2 V1 CN
+	l := len(req)
+	if l != 13 {
+		return &Reading{}, fmt.Errorf("Expecting 13 bytes got %d", l)
+	}
+	// Temperature is stored big endian in tenths of a degree
+	t := float64(int16(binary.BigEndian.Uint16(req[6:8]))) / 10.0
+	h := float64(req[8])
+	v := float64(binary.BigEndian.Uint16(req[10:12])) / 1000
+	return &Reading{
+		Temperature: t,
+		Humidity:    h,
+		Voltage:     v,
+	}, nil
+}
+
+// UnmarshallPvvx converts a pvvx custom firmware advertisement into a Reading
+func UnmarshallPvvx(req []byte) (*Reading, error) {
+	// 00-05 06 07 08 09 10 11 12 13 14
+	// MAC   T1 T2 H1 H2 V1 V2 B% CN FL
+	l := len(req)
+	if l != 15 {
+		return &Reading{}, fmt.Errorf("Expecting 15 bytes got %d", l)
+	}
+	// All values are stored little endian in hundredths
+	t := float64(int16(binary.LittleEndian.Uint16(req[6:8]))) / 100.0
+	h := float64(binary.LittleEndian.Uint16(req[8:10])) / 100.0
+	v := float64(binary.LittleEndian.Uint16(req[10:12])) / 1000
+	return &Reading{
+		Temperature: t,
+		Humidity:    h,
+		Voltage:     v,
+	}, nil
+}
+
+// UnmarshallLYWSD02 converts an encoded LYWSD02 reading into a Reading
+func UnmarshallLYWSD02(req []byte) (*Reading, error) {
+	// 00 01 02
+	// T2 T1 HX
+	l := len(req)
+	if l != 3 {
+		return &Reading{}, fmt.Errorf("Expecting 3 bytes got %d", l)
+	}
+	// Temperature is stored little endian
+	t := float64(int16(binary.LittleEndian.Uint16(req[0:2]))) / 100.0
+	h := float64(req[2])
+	return &Reading{
+		Temperature: t,
+		Humidity:    h,
+	}, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnmarshallCustomFirmware(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		decode func([]byte) (*Reading, error)
+		want   Reading
+	}{
+		{
+			// MAC a4:c1:38:00:00:01, 21.7 C, 45 %, 87 %, 2950 mV, counter 0x10
+			name:   "ATC",
+			data:   "a4c13800000100d92d570b8610",
+			decode: UnmarshallATC,
+			want:   Reading{Temperature: 21.7, Humidity: 45, Voltage: 2.95},
+		},
+		{
+			name:   "ATC negative temperature",
+			data:   "a4c138000001ffcb2d570b8610",
+			decode: UnmarshallATC,
+			want:   Reading{Temperature: -5.3, Humidity: 45, Voltage: 2.95},
+		},
+		{
+			// MAC a4:c1:38:00:00:01 little endian, 23.45 C, 56.78 %, 3012 mV, 92 %, counter 0x21, flags 0x04
+			name:   "pvvx",
+			data:   "01000038c1a429092e16c40b5c2104",
+			decode: UnmarshallPvvx,
+			want:   Reading{Temperature: 23.45, Humidity: 56.78, Voltage: 3.012},
+		},
+		{
+			name:   "pvvx negative temperature",
+			data:   "01000038c1a42efb2e16c40b5c2104",
+			decode: UnmarshallPvvx,
+			want:   Reading{Temperature: -12.34, Humidity: 56.78, Voltage: 3.012},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := tt.decode(unhex(t, tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*r, tt.want) {
+				t.Errorf("reading = %+v, want %+v", *r, tt.want)
+			}
+		})
+	}
+
+	if _, err := UnmarshallATC(unhex(t, "a4c138000001ffcb2d570b86")); err == nil {
+		t.Error("short ATC frame accepted")
+	}
+	if _, err := UnmarshallPvvx(unhex(t, "a4c13800000100d92d570b8610")); err == nil {
+		t.Error("ATC frame accepted as pvvx")
+	}
+}
+
+func TestScannerCustomFirmwareBattery(t *testing.T) {
+	for name, data := range map[string]string{
+		"atc-battery":  "a4c13800000100d92d570b8610",
+		"pvvx-battery": "01000038c1a429092e16c40b572104",
+	} {
+		d := Device{Name: name, Addr: "A4:C1:38:00:00:01", Mode: ModeScan}
+		s := NewScanner([]Device{d})
+		s.counters, s.seen = newFrameCounters(), make(map[string]bool)
+		s.handleCustomFirmware(d, unhex(t, data), -60)
+
+		if got, ok := GetReportedBattery(name); !ok || got != 87 {
+			t.Errorf("%s: reported battery = %v %v, want 87", name, got, ok)
+		}
+		state, _ := stateStore.Get(name)
+		if got, _ := state.Value("battery"); got != 87 {
+			t.Errorf("%s: published battery = %v, want 87", name, got)
+		}
+	}
+}
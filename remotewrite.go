@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	remoteWriteSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mi_remote_write_samples_total",
+		Help: "Samples handled by the remote-write client by result",
+	},
+		[]string{"result"})
+	remoteWriteQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mi_remote_write_queue_readings",
+		Help: "Readings waiting in the remote-write queue",
+	})
+	remoteWriteLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mi_remote_write_last_success_timestamp_seconds",
+		Help: "Time of the last successful remote-write request",
+	})
+)
+
+// remoteWritePending is the number of readings buffered in memory before they reach the DiskQueue
+const remoteWritePending = 1000
+
+// queuedSample is one sample with its full label set as stored in the queue
+type queuedSample struct {
+	Labels    map[string]string `json:"labels"`
+	Value     float64           `json:"value"`
+	Timestamp int64             `json:"timestamp"`
+}
+
+// DiskQueue is a FIFO of readings kept as one file per entry so it survives restarts
+type DiskQueue struct {
+	dir string
+	max int
+
+	mu      sync.Mutex
+	next    uint64
+	entries []string
+}
+
+// NewDiskQueue opens the queue in dir, keeping at most max entries
+func NewDiskQueue(dir string, max int) (*DiskQueue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &DiskQueue{dir: dir, max: max}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.entries = append(q.entries, name)
+		if seq >= q.next {
+			q.next = seq + 1
+		}
+	}
+	// Zero padded names sort in queue order
+	sort.Strings(q.entries)
+	remoteWriteQueueLength.Set(float64(len(q.entries)))
+	return q, nil
+}
+
+// Push appends a reading to the queue, dropping the oldest when full
+func (q *DiskQueue) Push(samples []queuedSample) error {
+	data, err := json.Marshal(samples)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	name := fmt.Sprintf("%020d.json", q.next)
+	tmp := filepath.Join(q.dir, name+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir, name)); err != nil {
+		return err
+	}
+	q.next++
+	q.entries = append(q.entries, name)
+
+	for len(q.entries) > q.max {
+		slog.Warn("Remote-write queue full, dropping oldest reading", "entry", q.entries[0])
+		if dropped, err := q.read(q.entries[0]); err == nil {
+			remoteWriteSamples.WithLabelValues("dropped").Add(float64(len(dropped)))
+		}
+		os.Remove(filepath.Join(q.dir, q.entries[0]))
+		q.entries = q.entries[1:]
+	}
+	remoteWriteQueueLength.Set(float64(len(q.entries)))
+	return nil
+}
+
+// Peek returns up to n of the oldest entries
+func (q *DiskQueue) Peek(n int) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n = min(n, len(q.entries))
+	return append([]string(nil), q.entries[:n]...)
+}
+
+// Read returns the samples of an entry
+func (q *DiskQueue) Read(entry string) ([]queuedSample, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.read(entry)
+}
+
+// read returns the samples of an entry. Caller must hold mu.
+func (q *DiskQueue) read(entry string) ([]queuedSample, error) {
+	data, err := os.ReadFile(filepath.Join(q.dir, entry))
+	if err != nil {
+		return nil, err
+	}
+	var samples []queuedSample
+	err = json.Unmarshal(data, &samples)
+	return samples, err
+}
+
+// Remove deletes entries from the head of the queue
+func (q *DiskQueue) Remove(entries []string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	remove := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		remove[e] = true
+		if err := os.Remove(filepath.Join(q.dir, e)); err != nil && !os.IsNotExist(err) {
+			slog.Error("Unable to remove remote-write queue entry", "entry", e, "error", err)
+		}
+	}
+	kept := q.entries[:0]
+	for _, e := range q.entries {
+		if !remove[e] {
+			kept = append(kept, e)
+		}
+	}
+	q.entries = kept
+	remoteWriteQueueLength.Set(float64(len(q.entries)))
+}
+
+// RemoteWriter pushes every reading to a Prometheus remote-write endpoint through a DiskQueue
+type RemoteWriter struct {
+	url       string
+	client    *http.Client
+	queue     *DiskQueue
+	naming    *MetricNaming
+	batchSize int
+	wake      chan struct{}
+
+	// pending hands readings from the listener to the disk writer, so no file I/O runs on the BLE path
+	pending chan []queuedSample
+}
+
+// NewRemoteWriter returns a RemoteWriter sending up to batchSize queued readings per request
+func NewRemoteWriter(url string, queue *DiskQueue, naming *MetricNaming, batchSize int) *RemoteWriter {
+	return &RemoteWriter{
+		url:       url,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		queue:     queue,
+		naming:    naming,
+		batchSize: batchSize,
+		wake:      make(chan struct{}, 1),
+		pending:   make(chan []queuedSample, remoteWritePending),
+	}
+}
+
+// Enqueue hands a reading to Run for queueing without blocking. It is a StateStore Listener.
+func (w *RemoteWriter) Enqueue(name string, values map[string]float64, t time.Time) {
+	samples := make([]queuedSample, 0, len(values))
+	for measurement, value := range values {
+		labels := map[string]string{
+			"__name__": w.naming.MetricName(defaultNamespace + "_" + measurement),
+			"location": name,
+		}
+		for k, v := range w.naming.DeviceLabels(name) {
+			if v != "" {
+				labels[k] = v
+			}
+		}
+		samples = append(samples, queuedSample{
+			Labels:    labels,
+			Value:     value,
+			Timestamp: t.UnixMilli(),
+		})
+	}
+
+	select {
+	case w.pending <- samples:
+	default:
+		slog.Warn("Remote-write buffer full, dropping reading", "device", name)
+		remoteWriteSamples.WithLabelValues("dropped").Add(float64(len(samples)))
+	}
+}
+
+// persist moves buffered readings to the DiskQueue and wakes the sender
+func (w *RemoteWriter) persist() {
+	for samples := range w.pending {
+		if err := w.queue.Push(samples); err != nil {
+			slog.Error("Unable to queue reading for remote write", "error", err)
+			remoteWriteSamples.WithLabelValues("dropped").Add(float64(len(samples)))
+			continue
+		}
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run queues buffered readings on disk and sends the queue in order, retrying with backoff
+// while the endpoint is unreachable
+func (w *RemoteWriter) Run() {
+	go w.persist()
+
+	backoff := time.Second
+	for {
+		entries := w.queue.Peek(w.batchSize)
+		if len(entries) == 0 {
+			select {
+			case <-w.wake:
+			case <-time.After(30 * time.Second):
+			}
+			continue
+		}
+
+		var samples []queuedSample
+		for _, e := range entries {
+			s, err := w.queue.Read(e)
+			if err != nil {
+				slog.Error("Dropping unreadable remote-write queue entry", "entry", e, "error", err)
+			}
+			samples = append(samples, s...)
+		}
+
+		retry, err := w.send(samples)
+		if err != nil && retry {
+			slog.Warn("Remote write failed, retrying",
+				"error", err,
+				"readings", len(entries),
+				"backoff", backoff)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, time.Minute)
+			continue
+		}
+		backoff = time.Second
+
+		if err != nil {
+			slog.Error("Remote write rejected, dropping readings",
+				"error", err,
+				"readings", len(entries))
+			remoteWriteSamples.WithLabelValues("dropped").Add(float64(len(samples)))
+		} else {
+			remoteWriteSamples.WithLabelValues("sent").Add(float64(len(samples)))
+			remoteWriteLastSuccess.SetToCurrentTime()
+		}
+		w.queue.Remove(entries)
+	}
+}
+
+// send posts samples as one WriteRequest and reports whether a failure is worth retrying
+func (w *RemoteWriter) send(samples []queuedSample) (retry bool, err error) {
+	body := snappy.Encode(nil, encodeWriteRequest(samples))
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("remote write returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	default:
+		return false, fmt.Errorf("remote write returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+}
+
+// encodeWriteRequest encodes samples as a remote-write protobuf WriteRequest
+func encodeWriteRequest(samples []queuedSample) []byte {
+	var b []byte
+	for _, s := range samples {
+		names := make([]string, 0, len(s.Labels))
+		for name := range s.Labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		// TimeSeries: repeated Label labels = 1; repeated Sample samples = 2
+		var ts []byte
+		for _, name := range names {
+			var l []byte
+			l = protowire.AppendTag(l, 1, protowire.BytesType)
+			l = protowire.AppendString(l, name)
+			l = protowire.AppendTag(l, 2, protowire.BytesType)
+			l = protowire.AppendString(l, s.Labels[name])
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, l)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.Value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(s.Timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+
+		// WriteRequest: repeated TimeSeries timeseries = 1
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+	return b
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// receivedSample is one sample decoded by the stand-in receiver
+type receivedSample struct {
+	name      string
+	location  string
+	value     float64
+	timestamp int64
+}
+
+// decodeWriteRequest decodes the series of a remote-write WriteRequest
+func decodeWriteRequest(t *testing.T, b []byte) []receivedSample {
+	t.Helper()
+	var samples []receivedSample
+	for len(b) > 0 {
+		_, _, n := protowire.ConsumeTag(b)
+		ts, m := protowire.ConsumeBytes(b[n:])
+		if m < 0 {
+			t.Fatal("invalid TimeSeries")
+		}
+		b = b[n+m:]
+
+		var s receivedSample
+		for len(ts) > 0 {
+			num, _, n := protowire.ConsumeTag(ts)
+			field, m := protowire.ConsumeBytes(ts[n:])
+			if m < 0 {
+				t.Fatal("invalid TimeSeries field")
+			}
+			ts = ts[n+m:]
+			switch num {
+			case 1:
+				_, _, n := protowire.ConsumeTag(field)
+				name, m := protowire.ConsumeString(field[n:])
+				_, _, n2 := protowire.ConsumeTag(field[n+m:])
+				value, _ := protowire.ConsumeString(field[n+m+n2:])
+				switch name {
+				case "__name__":
+					s.name = value
+				case "location":
+					s.location = value
+				}
+			case 2:
+				_, _, n := protowire.ConsumeTag(field)
+				bits, m := protowire.ConsumeFixed64(field[n:])
+				_, _, n2 := protowire.ConsumeTag(field[n+m:])
+				timestamp, _ := protowire.ConsumeVarint(field[n+m+n2:])
+				s.value = math.Float64frombits(bits)
+				s.timestamp = int64(timestamp)
+			}
+		}
+		samples = append(samples, s)
+	}
+	return samples
+}
+
+func TestRemoteWriterReplaysQueueInOrder(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		failures = 2
+		received []receivedSample
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "snappy" {
+			t.Errorf("Content-Encoding = %q", r.Header.Get("Content-Encoding"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, body)
+		if err != nil {
+			t.Errorf("snappy: %v", err)
+		}
+		received = append(received, decodeWriteRequest(t, data)...)
+	}))
+	defer receiver.Close()
+
+	queue, err := NewDiskQueue(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	naming, err := NewMetricNaming(defaultNamespace, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewRemoteWriter(receiver.URL, queue, naming, 1)
+
+	start := time.UnixMilli(1700000000000)
+	for i := 0; i < 3; i++ {
+		w.Enqueue("kitchen", map[string]float64{"temperature": 20 + float64(i)}, start.Add(time.Duration(i)*time.Minute))
+	}
+	go w.Run()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		mu.Lock()
+		n := len(received)
+		mu.Unlock()
+		if n == 3 && len(queue.Peek(10)) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("received %d samples before the deadline", n)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, s := range received {
+		want := receivedSample{"mi_temperature", "kitchen", 20 + float64(i), start.Add(time.Duration(i) * time.Minute).UnixMilli()}
+		if s != want {
+			t.Errorf("sample %d = %+v, want %+v", i, s, want)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/currantlabs/ble"
+	"golang.org/x/net/context"
+)
+
+var (
+	// Environmental Sensing service data UUID used by ATC1441 and pvvx custom firmware
+	environmentalSensingUUID = ble.UUID16(0x181a)
+
+	// ATC1441 and pvvx custom firmware advertise the same measurements as LYWSD03MMC over GATT
+	customFirmwareModel = &Model{
+		Name:    "custom-firmware",
+		Metrics: []string{"temperature", "humidity", "voltage", "battery"},
+	}
+)
+
+// scannerTrigger identifies the advertisement scanner in BLE resets and mutex timings
+const scannerTrigger = "scanner"
+
+// Scanner passively collects readings from advertising devices
+type Scanner struct {
+	devices map[string]Device
+	replay  *frameCounters
+
+	mu       sync.Mutex
+	seen     map[string]bool
+	counters *frameCounters
+	done     func()
+}
+
+// NewScanner returns a Scanner for the given scan mode devices
+func NewScanner(devices []Device) *Scanner {
+	s := &Scanner{
+		devices: make(map[string]Device),
+		replay:  newFrameCounters(),
+	}
+	for _, d := range devices {
+		s.devices[strings.ToLower(d.Addr)] = d
+	}
+	return s
+}
+
+// handleAdvertisement decodes an advertisement from a known device and publishes the reading
+func (s *Scanner) handleAdvertisement(a ble.Advertisement) {
+	d, ok := s.devices[strings.ToLower(a.Address().String())]
+	if !ok {
+		return
+	}
+	if dbm := a.RSSI(); dbm != 0 {
+		d.Link = map[string]float64{MeasurementRSSI: float64(dbm)}
+	}
+
+	for _, sd := range a.ServiceData() {
+		switch {
+		case sd.UUID.Equal(environmentalSensingUUID):
+			s.handleCustomFirmware(d, sd.Data, a.RSSI())
+		case sd.UUID.Equal(miBeaconUUID):
+			s.handleMiBeacon(d, sd.Data, a.RSSI())
+		case sd.UUID.Equal(bthomeUUID):
+			s.handleBTHome(d, sd.Data, a.RSSI())
+		}
+	}
+}
+
+// handleCustomFirmware decodes ATC1441 and pvvx custom firmware service data
+func (s *Scanner) handleCustomFirmware(d Device, data []byte, rssi int) {
+	var r *Reading
+	var counter, battery byte
+	var err error
+	switch len(data) {
+	case 13:
+		r, err = UnmarshallATC(data)
+		battery, counter = data[9], data[12]
+	case 15:
+		r, err = UnmarshallPvvx(data)
+		battery, counter = data[12], data[13]
+	default:
+		slog.Debug("Ignoring unsupported advertisement format",
+			"device", d.Name,
+			"length", len(data))
+		return
+	}
+
+	if err != nil {
+		slog.Error("Unable to unmarshal advertisement",
+			"device", d.Name,
+			"data", hex.EncodeToString(data),
+			"error", err)
+		recordError(d.Name, StageDecode)
+		return
+	}
+
+	// Custom firmware repeats each frame, only the first one in a scan window is used
+	if !s.window().accept(d.Name, uint32(counter), 8) {
+		return
+	}
+	s.markSeen(d.Name)
+
+	slog.Info("Received sensor advertisement",
+		"device", d.Name,
+		"temperature", r.Temperature,
+		"humidity", r.Humidity,
+		"voltage", r.Voltage,
+		"batteryPercent", battery,
+		"rssi", rssi,
+		"rawData", hex.EncodeToString(data))
+
+	// The firmware reports its own battery estimate, preferred over the curve
+	setReportedBattery(d.Name, battery)
+	publishReading(&d, r, customFirmwareModel)
+}
+
+// handleMiBeacon decodes stock firmware MiBeacon service data
+func (s *Scanner) handleMiBeacon(d Device, data []byte, rssi int) {
+	b, err := UnmarshallMiBeacon(data, d.Addr, d.BindKey)
+	if err != nil {
+		slog.Error("Unable to unmarshal MiBeacon",
+			"device", d.Name,
+			"data", hex.EncodeToString(data),
+			"error", err)
+		recordError(d.Name, StageDecode)
+		return
+	}
+
+	// Encrypted frames carry a 32 bit counter, plain frames only the 8 bit one
+	bits := uint(8)
+	if b.Encrypted {
+		bits = 32
+	}
+	if !s.replay.accept(d.Name, b.Counter, bits) {
+		slog.Debug("Ignoring replayed MiBeacon frame",
+			"device", d.Name,
+			"counter", b.Counter)
+		return
+	}
+	if len(b.Values) == 0 {
+		return
+	}
+	s.markSeen(d.Name)
+
+	slog.Info("Received MiBeacon advertisement",
+		"device", d.Name,
+		"productId", b.ProductID,
+		"version", b.Version,
+		"encrypted", b.Encrypted,
+		"values", b.Values,
+		"rssi", rssi,
+		"rawData", hex.EncodeToString(data))
+
+	publishMeasurements(&d, b.Values)
+}
+
+// handleBTHome decodes BTHome v2 service data
+func (s *Scanner) handleBTHome(d Device, data []byte, rssi int) {
+	b, err := UnmarshallBTHome(data, d.Addr, d.BindKey)
+	if err != nil {
+		slog.Error("Unable to unmarshal BTHome",
+			"device", d.Name,
+			"data", hex.EncodeToString(data),
+			"error", err)
+		recordError(d.Name, StageDecode)
+		return
+	}
+
+	// Encrypted frames carry a 32 bit counter, plain frames an optional 8 bit packet id
+	switch {
+	case b.Encrypted:
+		if !s.replay.accept(d.Name, b.Counter, 32) {
+			slog.Debug("Ignoring replayed BTHome frame",
+				"device", d.Name,
+				"counter", b.Counter)
+			return
+		}
+	case b.PacketID >= 0:
+		if !s.window().accept(d.Name, uint32(b.PacketID), 8) {
+			return
+		}
+	}
+	if len(b.Values) == 0 {
+		return
+	}
+	s.markSeen(d.Name)
+
+	slog.Info("Received BTHome advertisement",
+		"device", d.Name,
+		"encrypted", b.Encrypted,
+		"values", b.Values,
+		"rssi", rssi,
+		"rawData", hex.EncodeToString(data))
+
+	publishMeasurements(&d, b.Values)
+}
+
+// window returns the frame counters of the current scan window
+func (s *Scanner) window() *frameCounters {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counters
+}
+
+// markSeen records that a device reported in this scan window
+func (s *Scanner) markSeen(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seen[name] = true
+
+	// Stop scanning early once every device has reported
+	if len(s.seen) == len(s.devices) && s.done != nil {
+		s.done()
+	}
+}
+
+// scan listens for advertisements until every device reported or the duration elapsed
+func (s *Scanner) scan(duration time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+
+	s.mu.Lock()
+	s.seen = make(map[string]bool)
+	s.counters = newFrameCounters()
+	s.done = cancel
+	s.mu.Unlock()
+
+	if bleDevice == nil {
+		return 0, errors.New("BLE device not available")
+	}
+
+	err := bleDevice.Scan(ctx, true, s.handleAdvertisement)
+
+	s.mu.Lock()
+	s.done = nil
+	seen := len(s.seen)
+	s.mu.Unlock()
+
+	if err != nil && err != context.DeadlineExceeded && err != context.Canceled {
+		return seen, err
+	}
+	return seen, nil
+}
+
+// RegisterScanner periodically scans for advertisements from scan mode devices
+func RegisterScanner(devices []Device) {
+	s := NewScanner(devices)
+	consecutiveFailures := 0
+	// Scan windows in a row without an advertisement from each device
+	missed := make(map[string]int)
+	scanWindow := time.Duration(*scanDuration) * time.Second
+
+	for {
+		slog.Info("Waiting for BLE device access", "device", scannerTrigger)
+		waitStart := time.Now()
+		bleMutex.Lock()
+		observeSince(mutexWaitDuration, scannerTrigger, waitStart)
+		acquired := time.Now()
+		slog.Info("Acquired BLE device access", "device", scannerTrigger)
+
+		seen, err := s.scan(scanWindow)
+		success := err == nil && seen > 0
+		if err != nil {
+			consecutiveFailures++
+			slog.Error("Scan error",
+				"error", err,
+				"failureCount", consecutiveFailures)
+			if consecutiveFailures >= 3 {
+				slog.Warn("Requesting BLE device reset due to persistent scan issues")
+				RequestBLEDeviceReset(scannerTrigger)
+				consecutiveFailures = 0
+			}
+		} else {
+			consecutiveFailures = 0
+		}
+
+		for _, d := range devices {
+			s.mu.Lock()
+			reported := s.seen[d.Name]
+			s.mu.Unlock()
+			if reported {
+				missed[d.Name] = 0
+			} else {
+				missed[d.Name]++
+				slog.Warn("No advertisement received during scan window",
+					"device", d.Name,
+					"scanWindow", scanWindow,
+					"missedWindows", missed[d.Name])
+			}
+			SetConsecutiveFailures(d.Name, missed[d.Name])
+		}
+
+		slog.Info("Releasing BLE device access", "device", scannerTrigger)
+		observeSince(mutexHoldDuration, scannerTrigger, acquired)
+		bleMutex.Unlock()
+
+		waitTime := calculateWaitTime(success)
+		slog.Info("Waiting before next scan",
+			"devices", len(devices),
+			"received", seen,
+			"waitTime", waitTime)
+		time.Sleep(waitTime)
+	}
+}
+
+// parseMAC converts a device address into its 6 bytes
+func parseMAC(addr string) ([]byte, error) {
+	hw, err := net.ParseMAC(addr)
+	if err != nil || len(hw) != 6 {
+		return nil, fmt.Errorf("Invalid device address %q", addr)
+	}
+	return hw, nil
+}
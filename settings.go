@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/currantlabs/ble"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Device firmware variants
+const (
+	FirmwareStock = "stock"
+	FirmwarePvvx  = "pvvx"
+)
+
+// Setting names used as keys in the per-device config section
+const (
+	SettingClock               = "clock_sync"
+	SettingDisplayUnit         = "display_unit"
+	SettingComfort             = "comfort"
+	SettingAdvertisingInterval = "advertising_interval"
+	SettingConnectionLatency   = "connection_latency"
+)
+
+var (
+	// Xiaomi clock and display unit characteristics
+	xiaomiClockUUID = ble.MustParse("ebe0ccb7-7a0a-4b0c-8a1a-6ff2997da3a6")
+	xiaomiUnitsUUID = ble.MustParse("ebe0ccbe-7a0a-4b0c-8a1a-6ff2997da3a6")
+
+	// pvvx custom firmware command service and characteristic
+	pvvxServiceUUID = ble.UUID16(0x1f10)
+	pvvxCommandUUID = ble.UUID16(0x1f1f)
+
+	settingWritesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mi_setting_writes_total",
+		Help: "MI device setting writes by result",
+	},
+		[]string{"location", "setting", "result"})
+	settingInSync = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mi_setting_in_sync",
+		Help: "Whether the MI device setting matched the configured value after the last session",
+	},
+		[]string{"location", "setting"})
+)
+
+// pvvx command bytes
+const (
+	pvvxCmdComfort = 0x20
+	pvvxCmdTime    = 0x23
+	pvvxCmdConfig  = 0x55
+)
+
+// pvvx config offsets in the config command response
+const (
+	pvvxCfgAdvertisingInterval = 5
+	pvvxCfgConnectLatency      = 8
+)
+
+// Setting describes a device setting that can be read and written over GATT
+type Setting struct {
+	// Read returns the current device value
+	Read func(d *Device) ([]byte, error)
+	// Encode returns the desired device value for the configured value
+	Encode func(value string, current []byte) ([]byte, error)
+	// InSync reports whether the current device value matches the desired one
+	InSync func(current, desired []byte) bool
+	// Write stores the desired value on the device
+	Write func(d *Device, desired []byte) error
+	// Validate checks a configured value before any device is contacted, nil accepts any value
+	Validate func(value string) error
+}
+
+// stockClockSetting sets the RTC of stock Xiaomi firmware
+var stockClockSetting = &Setting{
+	Read:   characteristicReader(xiaomiClockUUID),
+	Encode: encodeClock(0),
+	InSync: clockInSync(0),
+	Write:  characteristicWriter(xiaomiClockUUID),
+}
+
+// stockSettings are supported by the stock Xiaomi firmware of the LYWSD03MMC family
+var stockSettings = map[string]*Setting{
+	SettingClock: stockClockSetting,
+	SettingDisplayUnit: {
+		Read:     characteristicReader(xiaomiUnitsUUID),
+		Encode:   encodeDisplayUnit(0x00, 0x01),
+		InSync:   bytes.Equal,
+		Write:    characteristicWriter(xiaomiUnitsUUID),
+		Validate: validateDisplayUnit,
+	},
+}
+
+// lywsd02Settings are supported by the stock LYWSD02 firmware
+var lywsd02Settings = map[string]*Setting{
+	SettingClock: stockClockSetting,
+	SettingDisplayUnit: {
+		Read:     characteristicReader(xiaomiUnitsUUID),
+		Encode:   encodeDisplayUnit(0xff, 0x01),
+		InSync:   bytes.Equal,
+		Write:    characteristicWriter(xiaomiUnitsUUID),
+		Validate: validateDisplayUnit,
+	},
+}
+
+// pvvxSettings are supported by the pvvx custom firmware command interface
+var pvvxSettings = map[string]*Setting{
+	SettingClock: {
+		Read:   pvvxReader(pvvxCmdTime),
+		Encode: encodeClock(pvvxCmdTime),
+		InSync: clockInSync(1),
+		Write:  pvvxWriter,
+	},
+	SettingComfort: {
+		Read:     pvvxReader(pvvxCmdComfort),
+		Encode:   encodeComfort,
+		InSync:   bytes.Equal,
+		Write:    pvvxWriter,
+		Validate: validateComfort,
+	},
+	SettingAdvertisingInterval: {
+		Read:     pvvxReader(pvvxCmdConfig),
+		Encode:   encodePvvxConfig(pvvxCfgAdvertisingInterval, 62.5),
+		InSync:   bytes.Equal,
+		Write:    pvvxWriter,
+		Validate: validatePvvxConfig(62.5),
+	},
+	SettingConnectionLatency: {
+		Read:     pvvxReader(pvvxCmdConfig),
+		Encode:   encodePvvxConfig(pvvxCfgConnectLatency, 20),
+		InSync:   bytes.Equal,
+		Write:    pvvxWriter,
+		Validate: validatePvvxConfig(20),
+	},
+}
+
+// settingsFor returns the settings supported by a model running the given firmware
+func settingsFor(m *Model, firmware string) map[string]*Setting {
+	if firmware == FirmwarePvvx {
+		return pvvxSettings
+	}
+	return m.Settings
+}
+
+// characteristicReader reads a setting from a characteristic
+func characteristicReader(u ble.UUID) func(d *Device) ([]byte, error) {
+	return func(d *Device) ([]byte, error) {
+		c, err := d.settingCharacteristic(d.Model.Service, u)
+		if err != nil {
+			return nil, err
+		}
+		return d.Client.ReadCharacteristic(c)
+	}
+}
+
+// characteristicWriter writes a setting to a characteristic
+func characteristicWriter(u ble.UUID) func(d *Device, b []byte) error {
+	return func(d *Device, b []byte) error {
+		c, err := d.settingCharacteristic(d.Model.Service, u)
+		if err != nil {
+			return err
+		}
+		return d.Client.WriteCharacteristic(c, b, false)
+	}
+}
+
+// pvvxReader sends a pvvx get command and returns the response
+func pvvxReader(cmd byte) func(d *Device) ([]byte, error) {
+	return func(d *Device) ([]byte, error) {
+		return d.pvvxCommand([]byte{cmd})
+	}
+}
+
+// pvvxWriter sends a pvvx set command
+func pvvxWriter(d *Device, b []byte) error {
+	_, err := d.pvvxCommand(b)
+	return err
+}
+
+// settingCharacteristic looks up a setting characteristic in the discovered profile
+func (d *Device) settingCharacteristic(svc, u ble.UUID) (*ble.Characteristic, error) {
+	profile := d.Client.Profile()
+	if profile == nil {
+		return nil, errors.New("profile not discovered")
+	}
+	c := findCharacteristic(profile, svc, u)
+	if c == nil {
+		return nil, fmt.Errorf("characteristic %s not found", u.String())
+	}
+	return c, nil
+}
+
+// pvvxCommand writes a command to the pvvx command characteristic and waits for its response
+func (d *Device) pvvxCommand(cmd []byte) ([]byte, error) {
+	c, err := d.settingCharacteristic(pvvxServiceUUID, pvvxCommandUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	response := make(chan []byte, 1)
+	handler := func(req []byte) {
+		if len(req) > 0 && req[0] == cmd[0] {
+			select {
+			case response <- append([]byte(nil), req...):
+			default:
+			}
+		}
+	}
+	if err := d.Client.Subscribe(c, false, handler); err != nil {
+		return nil, err
+	}
+	defer d.Client.Unsubscribe(c, false)
+
+	if err := d.Client.WriteCharacteristic(c, cmd, false); err != nil {
+		return nil, err
+	}
+
+	select {
+	case b := <-response:
+		return b, nil
+	case <-time.After(3 * time.Second):
+		return nil, fmt.Errorf("no response to pvvx command 0x%02x", cmd[0])
+	}
+}
+
+// encodeClock returns an encoder of the host time, optionally prefixed by a command byte
+func encodeClock(cmd byte) func(string, []byte) ([]byte, error) {
+	return func(value string, _ []byte) ([]byte, error) {
+		b := []byte{}
+		if cmd != 0 {
+			b = append(b, cmd)
+		}
+		b = binary.LittleEndian.AppendUint32(b, uint32(time.Now().Unix()))
+		if cmd == 0 {
+			// Stock firmware also takes the timezone offset in hours
+			_, offset := time.Now().Zone()
+			b = append(b, byte(int8(offset/3600)))
+		}
+		return b, nil
+	}
+}
+
+// clockInSync returns a comparator accepting a device clock within the configured drift.
+// The timestamp starts at the given offset of the device value.
+func clockInSync(offset int) func(current, desired []byte) bool {
+	return func(current, _ []byte) bool {
+		if len(current) < offset+4 {
+			return false
+		}
+		device := time.Unix(int64(binary.LittleEndian.Uint32(current[offset:offset+4])), 0)
+		drift := time.Since(device)
+		if drift < 0 {
+			drift = -drift
+		}
+		return drift <= time.Duration(*clockMaxDrift)*time.Second
+	}
+}
+
+// encodeDisplayUnit returns an encoder of C or F into the given firmware values
+func encodeDisplayUnit(celsius, fahrenheit byte) func(string, []byte) ([]byte, error) {
+	return func(value string, _ []byte) ([]byte, error) {
+		switch strings.ToUpper(value) {
+		case "C":
+			return []byte{celsius}, nil
+		case "F":
+			return []byte{fahrenheit}, nil
+		}
+		return nil, fmt.Errorf("display unit must be C or F, got %q", value)
+	}
+}
+
+// validateDisplayUnit checks a display unit value
+func validateDisplayUnit(value string) error {
+	_, err := encodeDisplayUnit(0, 1)(value, nil)
+	return err
+}
+
+// validateComfort checks a comfort value
+func validateComfort(value string) error {
+	_, err := encodeComfort(value, nil)
+	return err
+}
+
+// encodeComfort encodes "tempLow,tempHigh,humidityLow,humidityHigh" into a pvvx comfort command
+func encodeComfort(value string, _ []byte) ([]byte, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("comfort must be tempLow,tempHigh,humidityLow,humidityHigh, got %q", value)
+	}
+
+	b := []byte{pvvxCmdComfort}
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid comfort value %q: %w", p, err)
+		}
+		// Temperatures are signed, humidities unsigned, both in hundredths
+		if i < 2 {
+			b = binary.LittleEndian.AppendUint16(b, uint16(int16(math.Round(v*100))))
+		} else {
+			b = binary.LittleEndian.AppendUint16(b, uint16(math.Round(v*100)))
+		}
+	}
+	return b, nil
+}
+
+// pvvxConfigByte converts an interval in ms into a pvvx config byte counting units of unit ms
+func pvvxConfigByte(value string, unit float64) (byte, error) {
+	ms, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid interval %q: %w", value, err)
+	}
+	v := math.Round(ms / unit)
+	if v < 1 || v > 255 {
+		return 0, fmt.Errorf("interval %s ms out of range %g-%g ms", value, unit, 255*unit)
+	}
+	return byte(v), nil
+}
+
+// validatePvvxConfig returns a validator of intervals stored in units of unit ms
+func validatePvvxConfig(unit float64) func(string) error {
+	return func(value string) error {
+		_, err := pvvxConfigByte(value, unit)
+		return err
+	}
+}
+
+// encodePvvxConfig returns an encoder setting one byte of the pvvx config from a value in ms
+func encodePvvxConfig(offset int, unit float64) func(string, []byte) ([]byte, error) {
+	return func(value string, current []byte) ([]byte, error) {
+		v, err := pvvxConfigByte(value, unit)
+		if err != nil {
+			return nil, err
+		}
+		if len(current) <= offset {
+			return nil, fmt.Errorf("pvvx config of %d bytes too short", len(current))
+		}
+
+		b := append([]byte(nil), current...)
+		b[offset] = v
+		return b, nil
+	}
+}
+
+// applySettings writes the configured settings that differ from the device values
+func (d *Device) applySettings() {
+	if len(d.Settings) == 0 {
+		return
+	}
+	supported := settingsFor(d.Model, d.Firmware)
+
+	names := make([]string, 0, len(d.Settings))
+	for name := range d.Settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		s := supported[name]
+		if s == nil {
+			continue
+		}
+		value := d.Settings[name]
+
+		current, err := s.Read(d)
+		if err != nil {
+			slog.Error("Error reading setting",
+				"device", d.Name,
+				"setting", name,
+				"error", err)
+			settingWritesCounter.WithLabelValues(d.Name, name, "failure").Inc()
+			settingInSync.WithLabelValues(d.Name, name).Set(0)
+			continue
+		}
+
+		desired, err := s.Encode(value, current)
+		if err != nil {
+			slog.Error("Invalid setting value",
+				"device", d.Name,
+				"setting", name,
+				"value", value,
+				"error", err)
+			settingWritesCounter.WithLabelValues(d.Name, name, "failure").Inc()
+			settingInSync.WithLabelValues(d.Name, name).Set(0)
+			continue
+		}
+
+		if s.InSync(current, desired) {
+			slog.Debug("Setting in sync",
+				"device", d.Name,
+				"setting", name)
+			settingInSync.WithLabelValues(d.Name, name).Set(1)
+			continue
+		}
+
+		slog.Info("Writing setting",
+			"device", d.Name,
+			"setting", name,
+			"value", value)
+		if err := s.Write(d, desired); err != nil {
+			slog.Error("Error writing setting",
+				"device", d.Name,
+				"setting", name,
+				"error", err)
+			settingWritesCounter.WithLabelValues(d.Name, name, "failure").Inc()
+			settingInSync.WithLabelValues(d.Name, name).Set(0)
+			continue
+		}
+
+		settingWritesCounter.WithLabelValues(d.Name, name, "success").Inc()
+		settingInSync.WithLabelValues(d.Name, name).Set(1)
+	}
+}
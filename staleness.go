@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Actions taken when a device stops reporting
+const (
+	StaleActionFlag = "flag"
+	StaleActionDrop = "drop"
+)
+
+// LastUpdate returns the time of the last reading of a device
+func LastUpdate(deviceName string) (time.Time, bool) {
+	state, ok := stateStore.Get(deviceName)
+	if !ok || state.Updated.IsZero() {
+		return time.Time{}, false
+	}
+	return state.Updated, true
+}
+
+// monitorStaleness flags or drops devices that did not report within maxAge
+func monitorStaleness(devices []Device, maxAge time.Duration, action string) {
+	start := time.Now()
+	stale := make(map[string]bool)
+
+	for {
+		time.Sleep(15 * time.Second)
+
+		for _, d := range devices {
+			last, ok := LastUpdate(d.Name)
+			if !ok {
+				last = start
+			}
+			age := time.Since(last)
+
+			if age <= maxAge {
+				stale[d.Name] = false
+				continue
+			}
+			if stale[d.Name] {
+				continue
+			}
+			stale[d.Name] = true
+
+			slog.Warn("Device is stale",
+				"device", d.Name,
+				"age", age.Round(time.Second),
+				"maxAge", maxAge,
+				"action", action)
+			stateStore.SetUp(d.Name, false)
+			if action == StaleActionDrop {
+				stateStore.Drop(d.Name)
+				connectionPHY.DeletePartialMatch(prometheus.Labels{"location": d.Name})
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	_ "embed"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed status.html
+var statusPage string
+
+// statusTemplate renders the status page, which has no external assets so it works from a scratch image
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"age":    formatAge,
+	"number": func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) },
+}).Parse(statusPage))
+
+// statusMeasurement is one latest value shown on the status page
+type statusMeasurement struct {
+	Name  string
+	Value float64
+}
+
+// statusDevice is one row of the status page
+type statusDevice struct {
+	DeviceStatus
+	Measurements []statusMeasurement
+	RSSI         *float64
+}
+
+// statusData is everything shown on the status page
+type statusData struct {
+	Now          time.Time
+	AdapterUp    bool
+	Adapter      AdapterInfo
+	ResetPending bool
+	ResetTrigger string
+	Resets       []ResetEvent
+	Devices      []statusDevice
+}
+
+// formatAge returns the time since t rounded to seconds, "never" without a time
+func formatAge(now time.Time, t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	return now.Sub(*t).Round(time.Second).String()
+}
+
+// statusHandler serves the HTML status page
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	data := statusData{
+		Now:          time.Now(),
+		AdapterUp:    AdapterUp(),
+		Adapter:      GetAdapterInfo(),
+		ResetPending: IsBLEDeviceResetRequested(),
+		ResetTrigger: BLEDeviceResetTrigger(),
+		Resets:       ResetHistory(),
+	}
+	for _, d := range globalConfig.Devices {
+		s := statusDevice{DeviceStatus: deviceStatus(d)}
+		for m, v := range s.Reading {
+			if m == MeasurementRSSI {
+				s.RSSI = &v
+				continue
+			}
+			s.Measurements = append(s.Measurements, statusMeasurement{m, v})
+		}
+		sort.Slice(s.Measurements, func(i, j int) bool { return s.Measurements[i].Name < s.Measurements[j].Name })
+		if d.Mode == ModeScan {
+			s.Poll = "listening"
+		} else if s.Poll == "" {
+			s.Poll = "starting"
+		}
+		data.Devices = append(data.Devices, s)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, data); err != nil {
+		slog.Error("Unable to render status page", "error", err)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Sample is a measurement value with the time it was received
+type Sample struct {
+	Value float64
+	Time  time.Time
+}
+
+// DeviceState is the latest known state of a device
+type DeviceState struct {
+	Name    string
+	Samples map[string]Sample
+	Updated time.Time
+	Up      bool
+	// Poll is the current step of the poll loop of connect mode devices
+	Poll string
+}
+
+// Value returns the latest value of a measurement
+func (s *DeviceState) Value(measurement string) (float64, bool) {
+	sample, ok := s.Samples[measurement]
+	return sample.Value, ok
+}
+
+// Listener is called with the values and time of every reading merged into the store
+type Listener func(name string, values map[string]float64, t time.Time)
+
+// UpListener is called when a device becomes up or down
+type UpListener func(name string, up bool)
+
+// StateStore holds the latest state of every device
+type StateStore struct {
+	mu          sync.RWMutex
+	devices     map[string]*DeviceState
+	listeners   []Listener
+	upListeners []UpListener
+}
+
+// NewStateStore returns an empty StateStore
+func NewStateStore() *StateStore {
+	return &StateStore{
+		devices: make(map[string]*DeviceState),
+	}
+}
+
+// stateStore is shared by the readers and every output
+var stateStore = NewStateStore()
+
+// device returns the state of a device, creating it if needed. Caller must hold mu.
+func (s *StateStore) device(name string) *DeviceState {
+	d, ok := s.devices[name]
+	if !ok {
+		d = &DeviceState{
+			Name:    name,
+			Samples: make(map[string]Sample),
+		}
+		s.devices[name] = d
+	}
+	return d
+}
+
+// Add registers a device so it is reported before its first reading
+func (s *StateStore) Add(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.device(name)
+}
+
+// Listen registers a Listener for every following reading
+func (s *StateStore) Listen(l Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, l)
+}
+
+// ListenUp registers an UpListener for every following availability change
+func (s *StateStore) ListenUp(l UpListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.upListeners = append(s.upListeners, l)
+}
+
+// notifyUp calls the UpListeners if the availability changed
+func (s *StateStore) notifyUp(name string, changed, up bool) {
+	if !changed {
+		return
+	}
+	s.mu.RLock()
+	listeners := s.upListeners
+	s.mu.RUnlock()
+	for _, l := range listeners {
+		l(name, up)
+	}
+}
+
+// Update merges the values of one reading into the device state, marks it up and notifies the listeners
+func (s *StateStore) Update(name string, values map[string]float64, t time.Time) {
+	s.mu.Lock()
+	d := s.device(name)
+	for measurement, value := range values {
+		d.Samples[measurement] = Sample{Value: value, Time: t}
+	}
+	d.Updated = t
+	changed := !d.Up
+	d.Up = true
+	listeners := s.listeners
+	s.mu.Unlock()
+
+	for _, l := range listeners {
+		l(name, values, t)
+	}
+	s.notifyUp(name, changed, true)
+}
+
+// SetUp changes whether the device is considered up
+func (s *StateStore) SetUp(name string, isUp bool) {
+	s.mu.Lock()
+	d := s.device(name)
+	changed := d.Up != isUp
+	d.Up = isUp
+	s.mu.Unlock()
+
+	s.notifyUp(name, changed, isUp)
+}
+
+// SetPoll records the current poll loop step of a device
+func (s *StateStore) SetPoll(name, step string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.device(name).Poll = step
+}
+
+// Drop removes the samples of a device, keeping its last update time
+func (s *StateStore) Drop(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.device(name).Samples = make(map[string]Sample)
+}
+
+// Get returns a copy of the state of a device
+func (s *StateStore) Get(name string) (DeviceState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	d, ok := s.devices[name]
+	if !ok {
+		return DeviceState{}, false
+	}
+	return d.copy(), true
+}
+
+// Snapshot returns a consistent copy of the state of every device
+func (s *StateStore) Snapshot() []DeviceState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	states := make([]DeviceState, 0, len(s.devices))
+	for _, d := range s.devices {
+		states = append(states, d.copy())
+	}
+	return states
+}
+
+// copy returns a deep copy of the device state
+func (d *DeviceState) copy() DeviceState {
+	c := *d
+	c.Samples = make(map[string]Sample, len(d.Samples))
+	for k, v := range d.Samples {
+		c.Samples[k] = v
+	}
+	return c
+}
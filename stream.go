@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/net/websocket"
+)
+
+// Stream event types
+const (
+	EventReading        = "reading"
+	EventConnected      = "connected"
+	EventFailed         = "failed"
+	EventResetRequested = "reset_requested"
+	EventUp             = "up"
+	EventDown           = "down"
+)
+
+// streamBuffer is the number of events queued per client before new events are dropped for it
+const streamBuffer = 64
+
+var streamDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "mi_stream_events_dropped_total",
+	Help: "Live stream events dropped because a client was too slow",
+})
+
+// Event is a reading or device state change sent to stream clients
+type Event struct {
+	Type   string             `json:"type"`
+	Device string             `json:"device,omitempty"`
+	Time   time.Time          `json:"time"`
+	Values map[string]float64 `json:"values,omitempty"`
+	Detail string             `json:"detail,omitempty"`
+}
+
+// streamClient receives the events of the devices it asked for, all devices if empty
+type streamClient struct {
+	devices map[string]bool
+	events  chan Event
+}
+
+// wants reports whether the client is interested in an event. Adapter-wide events have no device.
+func (c *streamClient) wants(e Event) bool {
+	return len(c.devices) == 0 || e.Device == "" || c.devices[e.Device]
+}
+
+// StreamHub fans events out to stream clients without ever blocking the publisher
+type StreamHub struct {
+	mu      sync.RWMutex
+	clients map[*streamClient]bool
+}
+
+// NewStreamHub returns an empty StreamHub
+func NewStreamHub() *StreamHub {
+	return &StreamHub{clients: make(map[*streamClient]bool)}
+}
+
+// streamHub is shared by the readers and the stream endpoints
+var streamHub = NewStreamHub()
+
+// Publish sends an event to every interested client, dropping it for clients whose queue is full
+func (h *StreamHub) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for c := range h.clients {
+		if !c.wants(e) {
+			continue
+		}
+		select {
+		case c.events <- e:
+		default:
+			streamDropped.Inc()
+		}
+	}
+}
+
+// PublishReading streams a reading. It is a StateStore Listener.
+func (h *StreamHub) PublishReading(name string, values map[string]float64, t time.Time) {
+	copied := make(map[string]float64, len(values))
+	for k, v := range values {
+		copied[k] = v
+	}
+	h.Publish(Event{Type: EventReading, Device: name, Time: t, Values: copied})
+}
+
+// PublishUp streams an availability change. It is a StateStore UpListener.
+func (h *StreamHub) PublishUp(name string, up bool) {
+	t := EventDown
+	if up {
+		t = EventUp
+	}
+	h.Publish(Event{Type: t, Device: name})
+}
+
+// subscribe registers a client for devices
+func (h *StreamHub) subscribe(devices []string) *streamClient {
+	c := &streamClient{
+		devices: make(map[string]bool),
+		events:  make(chan Event, streamBuffer),
+	}
+	for _, d := range devices {
+		c.devices[d] = true
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[c] = true
+	return c
+}
+
+// unsubscribe removes a client
+func (h *StreamHub) unsubscribe(c *streamClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, c)
+}
+
+// streamDevices returns the device filter of a request, given as repeated or comma separated device parameters
+func streamDevices(r *http.Request) []string {
+	var devices []string
+	for _, v := range r.URL.Query()["device"] {
+		for _, d := range strings.Split(v, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				devices = append(devices, d)
+			}
+		}
+	}
+	return devices
+}
+
+// streamHandler serves the live event stream as Server-Sent Events
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	c := streamHub.subscribe(streamDevices(r))
+	defer streamHub.unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case e := <-c.events:
+			data, err := json.Marshal(e)
+			if err != nil {
+				slog.Error("Unable to encode stream event", "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// streamWebSocketHandler serves the live event stream as JSON WebSocket messages
+var streamWebSocketHandler = websocket.Server{
+	Handler:   streamWebSocket,
+	Handshake: checkStreamOrigin,
+}
+
+// checkStreamOrigin accepts clients without an Origin header, which are not browsers, and pages
+// served from the exporter itself. Other origins are refused so that a foreign page cannot read
+// the stream through the browser of a visitor on the local network.
+func checkStreamOrigin(config *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if origin != nil && !strings.EqualFold(origin.Host, req.Host) {
+		return fmt.Errorf("origin %s not allowed", origin)
+	}
+	config.Origin = origin
+	return nil
+}
+
+// streamWebSocket sends the events of one WebSocket client
+func streamWebSocket(ws *websocket.Conn) {
+	defer ws.Close()
+	c := streamHub.subscribe(streamDevices(ws.Request()))
+	defer streamHub.unsubscribe(c)
+
+	// Clients only listen, a read error means the connection is gone
+	closed := make(chan struct{})
+	go func() {
+		var discard []byte
+		for websocket.Message.Receive(ws, &discard) == nil {
+		}
+		close(closed)
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case e := <-c.events:
+			ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := websocket.JSON.Send(ws, e); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestCheckStreamOrigin(t *testing.T) {
+	for origin, want := range map[string]bool{
+		"":                         true,
+		"http://exporter:8080":     true,
+		"http://EXPORTER:8080":     true,
+		"http://exporter:9090":     false,
+		"https://evil.example.com": false,
+	} {
+		req := httptest.NewRequest("GET", "http://exporter:8080/api/stream/ws", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		err := checkStreamOrigin(&websocket.Config{Version: websocket.ProtocolVersionHybi13}, req)
+		if got := err == nil; got != want {
+			t.Errorf("origin %q accepted = %v, want %v (%v)", origin, got, want, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// pollBuckets cover sub-second operations up to the full connection retry budget
+var pollBuckets = prometheus.ExponentialBuckets(0.05, 2, 12)
+
+var (
+	connectDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mi_poll_connect_duration_seconds",
+		Help:    "Time to connect to the MI sensor, including retries",
+		Buckets: pollBuckets,
+	},
+		[]string{"location"})
+	discoverDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mi_poll_discover_duration_seconds",
+		Help:    "Time to discover the MI sensor GATT profile, including retries",
+		Buckets: pollBuckets,
+	},
+		[]string{"location"})
+	firstNotificationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mi_poll_first_notification_seconds",
+		Help:    "Time from the subscribe request to the first MI sensor notification",
+		Buckets: pollBuckets,
+	},
+		[]string{"location"})
+	mutexHoldDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mi_ble_mutex_hold_seconds",
+		Help:    "Time the BLE device was held for one MI sensor poll, or one scan window with location scanner",
+		Buckets: pollBuckets,
+	},
+		[]string{"location"})
+	mutexWaitDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mi_ble_mutex_wait_seconds",
+		Help:    "Time an MI sensor poll or the scanner (location scanner) waited for the BLE device",
+		Buckets: pollBuckets,
+	},
+		[]string{"location"})
+)
+
+// observeSince records the time elapsed since start in a per-device histogram
+func observeSince(h *prometheus.HistogramVec, deviceName string, start time.Time) {
+	h.WithLabelValues(deviceName).Observe(time.Since(start).Seconds())
+}
+
+// timeFirstNotification wraps a notification handler to record when the first notification arrives
+func timeFirstNotification(deviceName string, handler func(req []byte)) func(req []byte) {
+	start := time.Now()
+	var once sync.Once
+	return func(req []byte) {
+		once.Do(func() {
+			observeSince(firstNotificationDuration, deviceName, start)
+		})
+		handler(req)
+	}
+}